@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The roles an API key can have. Every role is allowed to do
+// everything the roles before it is allowed to do.
+const (
+	roleNone     = ""
+	roleReader   = "reader"
+	roleUploader = "uploader"
+	roleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	roleNone:     0,
+	roleReader:   1,
+	roleUploader: 2,
+	roleAdmin:    3,
+}
+
+// The admin key used to create the first keys in the database.
+// It is never stored, only compared against the bearer token.
+var bootstrapKey string
+
+// When true the GET routes under /paragliding/api can be used without a key
+var publicRead = true
+
+type apiKeyContext struct{}
+
+// Checks that the request has a bearer token with at least the given role.
+// If it has, the key is put in the request context and the new request is returned.
+// Otherwise the error is written to the user and false is returned.
+// The reader role is not needed when AUTH_PUBLIC_READ is true.
+func authorize(w http.ResponseWriter, r *http.Request, role string) (*http.Request, bool) {
+	if role == roleReader && publicRead {
+		role = roleNone
+	}
+	if !authAttemptAllowed(w, r) {
+		return r, false
+	}
+	key, found, err := authenticate(r)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return r, false
+	}
+	if !found {
+		// A key that is not known counts as a failure even on the public routes
+		if role == roleNone && r.Header.Get("Authorization") == "" {
+			return r, true
+		}
+		authFailed(r)
+		if role == roleNone {
+			return r, true
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="paragliding"`)
+		handleError(w, r, &apiError{http.StatusUnauthorized, "unauthorized", "a valid API key is required", nil}, http.StatusUnauthorized)
+		return r, false
+	}
+	if roleLevels[key.Role] < roleLevels[role] {
+		handleError(w, r, fmt.Errorf("the %s role is required", role), http.StatusForbidden)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)), true
+}
+
+// Finds the API key sent in the Authorization header.
+// found is false if there was no header, or the key is unknown or revoked.
+func authenticate(r *http.Request) (key APIKey, found bool, err error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return key, false, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if token == "" {
+		return key, false, nil
+	}
+	if bootstrapKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapKey)) == 1 {
+		return APIKey{Name: "bootstrap", Role: roleAdmin}, true, nil
+	}
+	// Only the bootstrap key can be checked before the database is connected,
+	// which /metrics needs since it is not behind withStore
+	if !storeConnected.Load() {
+		return key, false, &apiError{http.StatusServiceUnavailable, "store_unavailable", "the database is not connected yet", nil}
+	}
+	return IGF.For(r).FindKeyByHash(hashKey(token))
+}
+
+// Returns the API key the request was authorized with
+func requestKey(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContext{}).(APIKey)
+	return key, ok
+}
+
+// Returns true if the key is allowed to change or delete the track,
+// which is the key that uploaded it and all admins
+func canModifyTrack(key APIKey, track Track) bool {
+	if key.Role == roleAdmin {
+		return true
+	}
+	return track.OwnerKey != "" && track.OwnerKey == key.ID.Hex()
+}
+
+// Keys are stored as a hex encoded sha256 hash
+func hashKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generates a new random key with 32 bytes of entropy
+func generateKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Inserts a new API key into the database
+func (m *IgcFiles) InsertKey(key APIKey) error {
+	return db.C(APIKEYS).Insert(&key)
+}
+
+// Returns all API keys, including the revoked ones
+func (m *IgcFiles) FindAllKeys() ([]APIKey, error) {
+	var keys []APIKey
+	err := db.C(APIKEYS).Find(nil).Sort("_id").All(&keys)
+	return keys, err
+}
+
+// Finds the key with the given hash that has not been revoked
+func (m *IgcFiles) FindKeyByHash(hash string) (APIKey, bool, error) {
+	var key APIKey
+	err := db.C(APIKEYS).Find(bson.M{"key_hash": hash, "revoked_at": bson.M{"$exists": false}}).One(&key)
+	if err == mgo.ErrNotFound {
+		return key, false, nil
+	}
+	return key, err == nil, err
+}
+
+// Marks a key as revoked and returns it
+func (m *IgcFiles) RevokeKey(id string) (APIKey, error) {
+	var key APIKey
+	now := time.Now().UTC()
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"revoked_at": now}},
+		ReturnNew: true,
+	}
+	_, err := db.C(APIKEYS).FindId(bson.ObjectIdHex(id)).Apply(change, &key)
+	return key, err
+}
+
+// Returns all the keys, without the hash of the key
+func handleGetAdminApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := IGF.For(r).FindAllKeys()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	JsonStringResponse(w, http.StatusOK, keys)
+}
+
+// Creates a new key with the given name and role.
+// This is the only time the key itself is returned.
+func handlePostAdminApiKeys(w http.ResponseWriter, r *http.Request) {
+	type getParams struct {
+		Name       string `json:"name"`
+		Role       string `json:"role"`
+		DailyQuota int    `json:"daily_quota"`
+	}
+	var params getParams
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if _, ok := roleLevels[params.Role]; !ok || params.Role == roleNone {
+		handleError(w, r, fmt.Errorf("unknown role %q", params.Role), http.StatusBadRequest)
+		return
+	}
+	if params.DailyQuota < unlimitedQuota {
+		handleError(w, r, fmt.Errorf("daily_quota must be %d for no limit, 0 for the default or a positive number", unlimitedQuota), http.StatusBadRequest)
+		return
+	}
+
+	token, err := generateKey()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	key := APIKey{
+		ID:         bson.NewObjectId(),
+		Name:       params.Name,
+		Role:       params.Role,
+		Hash:       hashKey(token),
+		Created:    time.Now().UTC(),
+		DailyQuota: params.DailyQuota,
+	}
+	if err := IGF.For(r).InsertKey(key); err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	type returnVal struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	JsonStringResponse(w, http.StatusCreated, returnVal{key, token})
+}
+
+// Revokes the key with the given ID, the key can not be used after this
+func handleDeleteAdminApiKey(w http.ResponseWriter, r *http.Request) {
+	// The router puts the {id} from the Url in the path values
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	key, err := IGF.For(r).RevokeKey(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	JsonStringResponse(w, http.StatusOK, key)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// All the settings of the program. They are read from, in order where the last one wins:
+// the defaults in defaultConfig, the config file, the environment and the command line flags.
+type Config struct {
+	Port       string          `yaml:"port"`
+	Storage    StorageConfig   `yaml:"storage"`
+	Server     ServerConfig    `yaml:"server"`
+	Log        LogConfig       `yaml:"log"`
+	Auth       AuthConfig      `yaml:"auth"`
+	Ingest     IngestConfig    `yaml:"ingest"`
+	Trash      TrashConfig     `yaml:"trash"`
+	Fetch      FetchConfig     `yaml:"fetch"`
+	Webhooks   WebhooksConfig  `yaml:"webhooks"`
+	CORS       CORSConfig      `yaml:"cors"`
+	RateLimits RateLimitConfig `yaml:"rate_limits"`
+}
+
+type StorageConfig struct {
+	// Only mongodb is supported
+	Backend string `yaml:"backend"`
+	// host:port of the database
+	Address  string `yaml:"address"`
+	Database string `yaml:"database"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+}
+
+type LogConfig struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+type AuthConfig struct {
+	AdminAPIKey      string `yaml:"admin_api_key"`
+	PublicRead       bool   `yaml:"public_read"`
+	UploadDailyQuota int    `yaml:"upload_daily_quota"`
+}
+
+type IngestConfig struct {
+	Workers              int   `yaml:"workers"`
+	Queue                int   `yaml:"queue"`
+	ImportMaxBytes       int64 `yaml:"import_max_bytes"`
+	DedupeIncludeGRecord bool  `yaml:"dedupe_include_grecord"`
+}
+
+type TrashConfig struct {
+	// 0 keeps the tracks in the trash forever
+	Retention time.Duration `yaml:"retention"`
+}
+
+type FetchConfig struct {
+	MaxBytes     int64         `yaml:"max_bytes"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxRedirects int           `yaml:"max_redirects"`
+	AllowPrivate bool          `yaml:"allow_private"`
+}
+
+type WebhooksConfig struct {
+	Queue   int           `yaml:"queue"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// The rate limits of the route groups, see ratelimit.go
+type RateLimitConfig struct {
+	TrustProxy bool       `yaml:"trust_proxy"`
+	Read       RateConfig `yaml:"read"`
+	Upload     RateConfig `yaml:"upload"`
+	Webhook    RateConfig `yaml:"webhook"`
+	Admin      RateConfig `yaml:"admin"`
+	// Failed authentications for each IP
+	Auth RateConfig `yaml:"auth"`
+}
+
+type RateConfig struct {
+	// Requests per second for each client, 0 turns the limit off
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string      `yaml:"allowed_origins"`
+	AllowedMethods string        `yaml:"allowed_methods"`
+	AllowedHeaders string        `yaml:"allowed_headers"`
+	MaxAge         time.Duration `yaml:"max_age"`
+}
+
+// The config the program runs with, set by applyConfig
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Port: "8080",
+		Storage: StorageConfig{
+			Backend:  "mongodb",
+			Database: "paragliding",
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       60 * time.Second,
+			WriteTimeout:      120 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		Auth: AuthConfig{
+			PublicRead: true,
+		},
+		Ingest: IngestConfig{
+			Workers:        4,
+			Queue:          100,
+			ImportMaxBytes: 100 << 20,
+		},
+		Trash: TrashConfig{
+			Retention: 30 * 24 * time.Hour,
+		},
+		Fetch: FetchConfig{
+			MaxBytes:     10 << 20,
+			Timeout:      20 * time.Second,
+			MaxRedirects: 3,
+		},
+		Webhooks: WebhooksConfig{
+			Queue:   100,
+			Timeout: 10 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: "GET, POST, PATCH, DELETE, OPTIONS",
+			AllowedHeaders: "Authorization, Content-Type, X-Request-ID",
+			MaxAge:         10 * time.Minute,
+		},
+		RateLimits: RateLimitConfig{
+			Read:    RateConfig{Rate: 20, Burst: 40},
+			Upload:  RateConfig{Rate: 0.2, Burst: 10},
+			Webhook: RateConfig{Rate: 0.1, Burst: 5},
+			Admin:   RateConfig{Rate: 5, Burst: 20},
+			Auth:    RateConfig{Rate: 0.1, Burst: 10},
+		},
+	}
+}
+
+// One setting that can be set in the config file, the environment and with a flag
+type setting struct {
+	// The key in the config file, like fetch.timeout. The flag is the same with - instead of . and _
+	Key string
+	Env string
+	// Secrets are redacted by -print-config
+	Secret bool
+	// Points to the field in the Config
+	Value interface{}
+}
+
+// Returns the flag name of the setting, like fetch-timeout
+func (s setting) Flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.Key)
+}
+
+// Lists every setting of c. The env names are the ones the program has always used.
+func settings(c *Config) []setting {
+	return []setting{
+		{"port", "PORT", false, &c.Port},
+		{"storage.backend", "STORAGE_BACKEND", false, &c.Storage.Backend},
+		{"storage.address", "MONGO_ADDRESS", false, &c.Storage.Address},
+		{"storage.database", "MONGO_DATABASE", false, &c.Storage.Database},
+		{"storage.username", "MONGO_USER", false, &c.Storage.Username},
+		{"storage.password", "MONGO_PASSWORD", true, &c.Storage.Password},
+		{"server.read_header_timeout", "SERVER_READ_HEADER_TIMEOUT", false, &c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", "SERVER_READ_TIMEOUT", false, &c.Server.ReadTimeout},
+		{"server.write_timeout", "SERVER_WRITE_TIMEOUT", false, &c.Server.WriteTimeout},
+		{"server.idle_timeout", "SERVER_IDLE_TIMEOUT", false, &c.Server.IdleTimeout},
+		{"server.shutdown_timeout", "SHUTDOWN_TIMEOUT", false, &c.Server.ShutdownTimeout},
+		{"log.format", "LOG_FORMAT", false, &c.Log.Format},
+		{"log.level", "LOG_LEVEL", false, &c.Log.Level},
+		{"auth.admin_api_key", "ADMIN_API_KEY", true, &c.Auth.AdminAPIKey},
+		{"auth.public_read", "AUTH_PUBLIC_READ", false, &c.Auth.PublicRead},
+		{"auth.upload_daily_quota", "UPLOAD_DAILY_QUOTA", false, &c.Auth.UploadDailyQuota},
+		{"ingest.workers", "INGEST_WORKERS", false, &c.Ingest.Workers},
+		{"ingest.queue", "INGEST_QUEUE", false, &c.Ingest.Queue},
+		{"ingest.import_max_bytes", "IMPORT_MAX_BYTES", false, &c.Ingest.ImportMaxBytes},
+		{"ingest.dedupe_include_grecord", "DEDUPE_INCLUDE_GRECORD", false, &c.Ingest.DedupeIncludeGRecord},
+		{"trash.retention", "TRASH_RETENTION", false, &c.Trash.Retention},
+		{"fetch.max_bytes", "FETCH_MAX_BYTES", false, &c.Fetch.MaxBytes},
+		{"fetch.timeout", "FETCH_TIMEOUT", false, &c.Fetch.Timeout},
+		{"fetch.max_redirects", "FETCH_MAX_REDIRECTS", false, &c.Fetch.MaxRedirects},
+		{"fetch.allow_private", "FETCH_ALLOW_PRIVATE", false, &c.Fetch.AllowPrivate},
+		{"webhooks.queue", "WEBHOOK_QUEUE", false, &c.Webhooks.Queue},
+		{"webhooks.timeout", "WEBHOOK_TIMEOUT", false, &c.Webhooks.Timeout},
+		{"cors.allowed_origins", "CORS_ALLOWED_ORIGINS", false, &c.CORS.AllowedOrigins},
+		{"cors.allowed_methods", "CORS_ALLOWED_METHODS", false, &c.CORS.AllowedMethods},
+		{"cors.allowed_headers", "CORS_ALLOWED_HEADERS", false, &c.CORS.AllowedHeaders},
+		{"cors.max_age", "CORS_MAX_AGE", false, &c.CORS.MaxAge},
+		{"rate_limits.trust_proxy", "RATE_LIMIT_TRUST_PROXY", false, &c.RateLimits.TrustProxy},
+		{"rate_limits.read.rate", "RATE_LIMIT_READ_RATE", false, &c.RateLimits.Read.Rate},
+		{"rate_limits.read.burst", "RATE_LIMIT_READ_BURST", false, &c.RateLimits.Read.Burst},
+		{"rate_limits.upload.rate", "RATE_LIMIT_UPLOAD_RATE", false, &c.RateLimits.Upload.Rate},
+		{"rate_limits.upload.burst", "RATE_LIMIT_UPLOAD_BURST", false, &c.RateLimits.Upload.Burst},
+		{"rate_limits.webhook.rate", "RATE_LIMIT_WEBHOOK_RATE", false, &c.RateLimits.Webhook.Rate},
+		{"rate_limits.webhook.burst", "RATE_LIMIT_WEBHOOK_BURST", false, &c.RateLimits.Webhook.Burst},
+		{"rate_limits.admin.rate", "RATE_LIMIT_ADMIN_RATE", false, &c.RateLimits.Admin.Rate},
+		{"rate_limits.admin.burst", "RATE_LIMIT_ADMIN_BURST", false, &c.RateLimits.Admin.Burst},
+		{"rate_limits.auth.rate", "RATE_LIMIT_AUTH_RATE", false, &c.RateLimits.Auth.Rate},
+		{"rate_limits.auth.burst", "RATE_LIMIT_AUTH_BURST", false, &c.RateLimits.Auth.Burst},
+	}
+}
+
+// Parses the text from the environment or a flag into the field the setting points to.
+// The field is not changed if the text is not valid.
+func (s setting) set(text string) error {
+	var err error
+	switch v := s.Value.(type) {
+	case *string:
+		*v = text
+	case *int:
+		var n int
+		if n, err = strconv.Atoi(text); err == nil {
+			*v = n
+		}
+	case *int64:
+		var n int64
+		if n, err = strconv.ParseInt(text, 10, 64); err == nil {
+			*v = n
+		}
+	case *float64:
+		var f float64
+		if f, err = strconv.ParseFloat(text, 64); err == nil {
+			*v = f
+		}
+	case *bool:
+		var b bool
+		if b, err = strconv.ParseBool(text); err == nil {
+			*v = b
+		}
+	case *time.Duration:
+		var d time.Duration
+		if d, err = time.ParseDuration(text); err == nil {
+			*v = d
+		}
+	case *[]string:
+		*v = splitList(text)
+	default:
+		err = fmt.Errorf("unsupported type %T", s.Value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %q", s.Key, text)
+	}
+	return nil
+}
+
+// The flags for the config, filled in by registerConfigFlags
+type configFlags struct {
+	File   *string
+	values map[string]*string
+	set    *flag.FlagSet
+}
+
+// Adds -config and one flag per setting to the flag set
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	flags := &configFlags{
+		File:   fs.String("config", os.Getenv("CONFIG_FILE"), "the yaml config file to read (env CONFIG_FILE)"),
+		values: map[string]*string{},
+		set:    fs,
+	}
+	defaults := defaultConfig()
+	for _, s := range settings(&defaults) {
+		usage := fmt.Sprintf("the same as %s in the config file, or env %s", s.Key, s.Env)
+		flags.values[s.Flag()] = fs.String(s.Flag(), "", usage)
+	}
+	return flags
+}
+
+// Reads the config from the defaults, the file, the environment and the flags, in that order
+func loadConfig(flags *configFlags) (Config, error) {
+	c := defaultConfig()
+
+	if *flags.File != "" {
+		content, err := os.ReadFile(*flags.File)
+		if err != nil {
+			return c, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		// Misspelled keys would otherwise be ignored without a word
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&c); err != nil && err != io.EOF {
+			return c, fmt.Errorf("%s: %w", *flags.File, err)
+		}
+	}
+
+	var errs []error
+	for _, s := range settings(&c) {
+		if val, ok := os.LookupEnv(s.Env); ok && val != "" {
+			if err := s.set(val); err != nil {
+				errs = append(errs, fmt.Errorf("env %s: %w", s.Env, err))
+			}
+		}
+	}
+	// Only the flags given on the command line are used
+	set := map[string]bool{}
+	flags.set.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range settings(&c) {
+		if set[s.Flag()] {
+			if err := s.set(*flags.values[s.Flag()]); err != nil {
+				errs = append(errs, fmt.Errorf("flag -%s: %w", s.Flag(), err))
+			}
+		}
+	}
+	return c, errors.Join(errs...)
+}
+
+// Returns every problem with the config, so they can all be fixed at once
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port: %q is not a port number", c.Port)
+	check(c.Storage.Backend == "mongodb", "storage.backend: %q is not supported, the only backend is mongodb", c.Storage.Backend)
+	check(c.Storage.Address != "", "storage.address: is required")
+	check(c.Storage.Database != "", "storage.database: is required")
+	for _, s := range []struct {
+		Key   string
+		Value time.Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+		{"fetch.timeout", c.Fetch.Timeout},
+		{"webhooks.timeout", c.Webhooks.Timeout},
+	} {
+		check(s.Value > 0, "%s: must be longer than 0", s.Key)
+	}
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format: %q is not text or json", c.Log.Format)
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level: %q is not debug, info, warn or error", c.Log.Level)
+	check(c.Auth.UploadDailyQuota >= 0, "auth.upload_daily_quota: can not be negative")
+	check(c.Ingest.Workers > 0, "ingest.workers: must be at least 1")
+	check(c.Ingest.Queue > 0, "ingest.queue: must be at least 1")
+	check(c.Ingest.ImportMaxBytes > 0, "ingest.import_max_bytes: must be larger than 0")
+	check(c.Trash.Retention >= 0, "trash.retention: can not be negative")
+	check(c.Fetch.MaxBytes > 0, "fetch.max_bytes: must be larger than 0")
+	check(c.Fetch.MaxRedirects >= 0, "fetch.max_redirects: can not be negative")
+	check(c.Webhooks.Queue > 0, "webhooks.queue: must be at least 1")
+	check(c.CORS.MaxAge >= 0, "cors.max_age: can not be negative")
+	for _, limit := range []struct {
+		Group string
+		RateConfig
+	}{
+		{limitRead, c.RateLimits.Read},
+		{limitUpload, c.RateLimits.Upload},
+		{limitWebhook, c.RateLimits.Webhook},
+		{limitAdmin, c.RateLimits.Admin},
+		{limitAuth, c.RateLimits.Auth},
+	} {
+		check(limit.Rate >= 0, "rate_limits.%s.rate: can not be negative", limit.Group)
+		check(limit.Rate == 0 || limit.Burst >= 1, "rate_limits.%s.burst: must be at least 1", limit.Group)
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the config as yaml, with the secrets replaced so it can be shared
+func (c Config) Redacted() ([]byte, error) {
+	for _, s := range settings(&c) {
+		if v, ok := s.Value.(*string); ok && s.Secret && *v != "" {
+			*v = "REDACTED"
+		}
+	}
+	// The slices are shared with the original, they have no secrets
+	c.CORS.AllowedOrigins = append([]string(nil), c.CORS.AllowedOrigins...)
+	return yaml.Marshal(c)
+}
+
+// Makes the program use the config
+func applyConfig(c Config) {
+	config = c
+	logger = newLogger(os.Stdout, c.Log.Format, c.Log.Level)
+	slog.SetDefault(logger)
+
+	IGF.Address = c.Storage.Address
+	IGF.Database = c.Storage.Database
+	IGF.Username = c.Storage.Username
+	IGF.Password = c.Storage.Password
+
+	serverReadHeaderTimeout = c.Server.ReadHeaderTimeout
+	serverReadTimeout = c.Server.ReadTimeout
+	serverWriteTimeout = c.Server.WriteTimeout
+	serverIdleTimeout = c.Server.IdleTimeout
+	shutdownTimeout = c.Server.ShutdownTimeout
+
+	bootstrapKey = c.Auth.AdminAPIKey
+	publicRead = c.Auth.PublicRead
+	defaultDailyQuota = c.Auth.UploadDailyQuota
+
+	ingestWorkers = c.Ingest.Workers
+	jobQueue = make(chan jobTask, c.Ingest.Queue)
+	importMaxBytes = c.Ingest.ImportMaxBytes
+	hashIncludeGRecord = c.Ingest.DedupeIncludeGRecord
+	trashRetention = c.Trash.Retention
+
+	fetchMaxBytes = c.Fetch.MaxBytes
+	fetchTimeout = c.Fetch.Timeout
+	fetchClient.Timeout = c.Fetch.Timeout
+	fetchMaxRedirects = c.Fetch.MaxRedirects
+	fetchAllowPrivate = c.Fetch.AllowPrivate
+
+	webhookQueue = make(chan webhookDelivery, c.Webhooks.Queue)
+	webhookClient.Timeout = c.Webhooks.Timeout
+
+	corsAllowedOrigins = c.CORS.AllowedOrigins
+	corsAllowedMethods = c.CORS.AllowedMethods
+	corsAllowedHeaders = c.CORS.AllowedHeaders
+	corsMaxAge = c.CORS.MaxAge
+
+	rateLimitTrustProxy = c.RateLimits.TrustProxy
+	rateLimiters = map[string]*rateLimiter{
+		limitRead:    newRateLimiter(c.RateLimits.Read.Rate, c.RateLimits.Read.Burst),
+		limitUpload:  newRateLimiter(c.RateLimits.Upload.Rate, c.RateLimits.Upload.Burst),
+		limitWebhook: newRateLimiter(c.RateLimits.Webhook.Rate, c.RateLimits.Webhook.Burst),
+		limitAdmin:   newRateLimiter(c.RateLimits.Admin.Rate, c.RateLimits.Admin.Burst),
+		limitAuth:    newRateLimiter(c.RateLimits.Auth.Rate, c.RateLimits.Auth.Burst),
+	}
+}
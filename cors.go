@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The CORS settings for browser frontends on other origins, set by applyConfig.
+// No origin is allowed by default, "*" allows all of them.
+var corsAllowedOrigins []string
+var corsAllowedMethods string
+var corsAllowedHeaders string
+var corsMaxAge time.Duration
+
+// The response headers the browser lets the frontend read
+const corsExposedHeaders = "X-Request-ID, Location, Retry-After"
+
+// The routes that get CORS headers
+const corsPathPrefix = "/paragliding/api"
+
+// Splits a comma separated list and removes the spaces
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Returns true if the frontend on origin can call the API
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range corsAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the CORS headers on requests to the API from an allowed origin.
+// Returns true if the request was a preflight and has been answered,
+// then the router should not handle it.
+func handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != corsPathPrefix && !strings.HasPrefix(r.URL.Path, corsPathPrefix+"/") {
+		return false
+	}
+	// The answer depends on the origin, so caches must keep them apart
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !corsOriginAllowed(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// An error with the status and code it should be answered with
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Details interface{}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// The body of every error response
+type errorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+var errInvalidID = &apiError{http.StatusBadRequest, "invalid_id", "the id is not a valid object id", nil}
+
+// The codes used when the error itself has no code
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusBadGateway:            "bad_gateway",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "gateway_timeout",
+}
+
+// Turns any error into an apiError. The status is used for errors
+// that do not tell what status they should have.
+func toAPIError(err error, status int) *apiError {
+	var ae *apiError
+	var fe *fetchError
+	switch {
+	case err == nil:
+		return &apiError{Status: status, Code: statusCodes[status], Message: http.StatusText(status)}
+	case errors.As(err, &ae):
+		return ae
+	case err == mgo.ErrNotFound:
+		return &apiError{http.StatusNotFound, "not_found", "not found", nil}
+	case errors.As(err, &fe):
+		return &apiError{fe.Status(), fe.Code, fe.Error(), nil}
+	case mgo.IsDup(err):
+		return &apiError{http.StatusConflict, "conflict", "already exists", nil}
+	case status >= http.StatusInternalServerError:
+		// The text of storage errors is not useful for users, and can tell too much.
+		// handleError logs it instead.
+		return &apiError{Status: status, Code: statusCodes[status], Message: http.StatusText(status)}
+	}
+	code, ok := statusCodes[status]
+	if !ok {
+		code = "error"
+	}
+	return &apiError{status, code, err.Error(), nil}
+}
+
+// Writes the error as json with the right status
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	resp := errorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Details:   e.Details,
+		RequestID: requestID(r),
+	}
+	body, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The report returned by POST /admin/api/import/igc
+type importReport struct {
+	Created    int `json:"created"`
+	Duplicates int `json:"duplicates"`
+	Errors     int `json:"errors"`
+	Files      []struct {
+		File   string `json:"file"`
+		Status string `json:"status"`
+		ID     string `json:"id"`
+		Error  string `json:"error"`
+	} `json:"files"`
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory to search for igc files")
+	server := flag.String("server", "http://localhost:8080", "address of the paragliding service")
+	flag.Parse()
+
+	// The key is read from the environment so it is not visible in the process list
+	key := os.Getenv("PARAGLIDING_API_KEY")
+	if key == "" {
+		log.Fatal("PARAGLIDING_API_KEY must be set to an admin key")
+	}
+
+	archive, count, err := zipDirectory(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if count == 0 {
+		fmt.Println("No igc files found in", *dir)
+		return
+	}
+	fmt.Printf("Importing %d igc files from %s\n", count, *dir)
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*server, "/")+"/admin/api/import/igc", archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "application/zip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Import failed with %s: %s", resp.Status, body)
+	}
+
+	var report importReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range report.Files {
+		switch file.Status {
+		case "error":
+			fmt.Printf("%-10s %s: %s\n", file.Status, file.File, file.Error)
+		default:
+			fmt.Printf("%-10s %s %s\n", file.Status, file.File, file.ID)
+		}
+	}
+	fmt.Printf("%d created, %d duplicates, %d errors\n", report.Created, report.Duplicates, report.Errors)
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// Walks the directory and puts every .igc file in a ZIP archive,
+// with the path relative to the directory as the name
+func zipDirectory(dir string) (*bytes.Buffer, int, error) {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".igc") {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		w, err := archive.Create(filepath.ToSlash(name))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf, count, archive.Close()
+}
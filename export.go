@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The kinds of records in an export
+const (
+	exportTrack   = "track"
+	exportWebhook = "webhook"
+)
+
+// What to do when an imported record has the same ID or content as a stored one
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictFail      = "fail"
+)
+
+// One line in an export. Type tells which of the other fields are set.
+type exportRecord struct {
+	Type    string    `json:"type"`
+	Track   *Track    `json:"track,omitempty"`
+	Igc     []byte    `json:"igc,omitempty"`
+	Webhook *Webhooks `json:"webhook,omitempty"`
+}
+
+// The number of records of one kind that were handled in an import
+type importCount struct {
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"`
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type importSummary struct {
+	Tracks   importCount   `json:"tracks"`
+	Webhooks importCount   `json:"webhooks"`
+	Errors   []importError `json:"errors"`
+}
+
+// This function stores the igc file of a track
+func (m *IgcFiles) InsertContent(id bson.ObjectId, content []byte) error {
+	_, err := db.C(IGCFILES).UpsertId(id, IgcContent{ID: id, Content: content})
+	return err
+}
+
+// This function returns the stored igc file of a track
+func (m *IgcFiles) FindContent(id bson.ObjectId) ([]byte, error) {
+	var content IgcContent
+	err := db.C(IGCFILES).FindId(id).One(&content)
+	return content.Content, err
+}
+
+// Writes every track, with its igc file, and every webhook to w as one json object per line.
+// Tracks in the trash are included, so an import gives back the same database.
+func (m *IgcFiles) Export(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+
+	var track Track
+	iter := db.C(COLLECTION).Find(nil).Sort("_id").Iter()
+	for iter.Next(&track) {
+		content, err := m.FindContent(track.ID)
+		if err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return err
+		}
+		t := track
+		if err := encoder.Encode(exportRecord{Type: exportTrack, Track: &t, Igc: content}); err != nil {
+			iter.Close()
+			return err
+		}
+		track = Track{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	var webhook Webhooks
+	iter = db.C(WEBHOOKS).Find(nil).Sort("_id").Iter()
+	for iter.Next(&webhook) {
+		hook := webhook
+		if err := encoder.Encode(exportRecord{Type: exportWebhook, Webhook: &hook}); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Stores one imported track with the ID it had in the export.
+// Returns if it was created or overwritten, or false for both if it was skipped.
+func (m *IgcFiles) ImportTrack(track Track, content []byte, onConflict string) (created bool, overwritten bool, err error) {
+	err = db.C(COLLECTION).Insert(&track)
+	if mgo.IsDup(err) {
+		switch onConflict {
+		case conflictSkip:
+			return false, false, nil
+		case conflictOverwrite:
+			// The stored flight can have another ID, then it is replaced by the imported one
+			if err = m.removeSameContent(track); err != nil {
+				return false, false, err
+			}
+			if _, err = db.C(COLLECTION).UpsertId(track.ID, &track); err != nil {
+				return false, false, err
+			}
+			overwritten = true
+		default:
+			return false, false, fmt.Errorf("track %s is already stored", track.ID.Hex())
+		}
+	} else if err != nil {
+		return false, false, err
+	} else {
+		created = true
+	}
+
+	if len(content) > 0 {
+		err = m.InsertContent(track.ID, content)
+	}
+	return created, overwritten, err
+}
+
+// Removes the stored track, and its igc file, with the same content hash as the
+// imported track but another ID, so the imported track can take its place
+func (m *IgcFiles) removeSameContent(track Track) error {
+	if track.ContentHash == "" {
+		return nil
+	}
+	var existing Track
+	err := db.C(COLLECTION).Find(bson.M{"content_hash": track.ContentHash, "_id": bson.M{"$ne": track.ID}}).One(&existing)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := db.C(COLLECTION).RemoveId(existing.ID); err != nil {
+		return err
+	}
+	if err := db.C(IGCFILES).RemoveId(existing.ID); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	m.logger().Info("Replaced a track with the same content", "removed", existing.ID.Hex(), "imported", track.ID.Hex())
+	return nil
+}
+
+// Stores one imported webhook with the ID it had in the export
+func (m *IgcFiles) ImportWebhook(webhook Webhooks, onConflict string) (created bool, overwritten bool, err error) {
+	err = db.C(WEBHOOKS).Insert(&webhook)
+	if !mgo.IsDup(err) {
+		return err == nil, false, err
+	}
+	switch onConflict {
+	case conflictSkip:
+		return false, false, nil
+	case conflictOverwrite:
+		_, err = db.C(WEBHOOKS).UpsertId(webhook.ID, &webhook)
+		return false, err == nil, err
+	default:
+		return false, false, fmt.Errorf("webhook %s is already stored", webhook.ID.Hex())
+	}
+}
+
+// Streams a full export of the database as newline delimited json
+func handleGetAdminApiExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="paragliding-export.ndjson"`)
+	if err := IGF.For(r).Export(w); err != nil {
+		// The status is already sent, so the best we can do is to stop the stream
+		// and log the error. The export will be missing its last lines.
+		logFrom(r.Context()).Error("Export failed", "err", err)
+	}
+}
+
+// Restores an export made by handleGetAdminApiExport.
+// ?on_conflict=skip|overwrite|fail decides what happens when a record is already stored,
+// the default is skip. With fail the import stops at the first conflict, but the
+// records before it are kept.
+func handlePostAdminApiImport(w http.ResponseWriter, r *http.Request) {
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = conflictSkip
+	}
+	if onConflict != conflictSkip && onConflict != conflictOverwrite && onConflict != conflictFail {
+		handleError(w, r, fmt.Errorf("unknown on_conflict %q", onConflict), http.StatusBadRequest)
+		return
+	}
+
+	summary := importSummary{Errors: []importError{}}
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	for line := 1; ; line++ {
+		var record exportRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			// The rest of the stream can not be read after a syntax error
+			summary.Errors = append(summary.Errors, importError{line, err.Error()})
+			handleError(w, r, &apiError{http.StatusBadRequest, "invalid_export", "the import could not be read", summary}, http.StatusBadRequest)
+			return
+		}
+
+		var created, overwritten bool
+		var err error
+		var count *importCount
+		switch {
+		case record.Type == exportTrack && record.Track != nil && record.Track.ID.Valid():
+			count = &summary.Tracks
+			created, overwritten, err = IGF.For(r).ImportTrack(*record.Track, record.Igc, onConflict)
+		case record.Type == exportWebhook && record.Webhook != nil && record.Webhook.ID.Valid():
+			count = &summary.Webhooks
+			created, overwritten, err = IGF.For(r).ImportWebhook(*record.Webhook, onConflict)
+		default:
+			err = fmt.Errorf("not a valid %q record", record.Type)
+		}
+		if err != nil {
+			summary.Errors = append(summary.Errors, importError{line, err.Error()})
+			if onConflict == conflictFail {
+				handleError(w, r, &apiError{http.StatusConflict, "import_conflict", "the import stopped at a conflict", summary}, http.StatusConflict)
+				return
+			}
+			continue
+		}
+		switch {
+		case created:
+			count.Created++
+		case overwritten:
+			count.Overwritten++
+		default:
+			count.Skipped++
+		}
+	}
+	JsonStringResponse(w, http.StatusOK, summary)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// The limits for downloading track files from the urls users send us, set by applyConfig
+var fetchMaxBytes int64
+var fetchTimeout time.Duration
+var fetchMaxRedirects int
+
+// Only for running locally, lets the service fetch from private addresses
+var fetchAllowPrivate bool
+
+// The error codes of a failed fetch
+const (
+	fetchInvalidURL       = "invalid_url"
+	fetchSchemeNotAllowed = "scheme_not_allowed"
+	fetchAddressBlocked   = "address_not_allowed"
+	fetchTooManyRedirects = "too_many_redirects"
+	fetchTooLarge         = "file_too_large"
+	fetchTimedOut         = "fetch_timeout"
+	fetchUnreachable      = "host_unreachable"
+	fetchBadStatus        = "upstream_status"
+)
+
+// The error returned when a track file could not be downloaded
+type fetchError struct {
+	Code string
+	Err  error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("fetching track failed (%s): %s", e.Code, e.Err)
+}
+
+// Returns the http status to answer with. It is the user's fault if the url is not allowed,
+// otherwise it is the host of the file that failed.
+func (e *fetchError) Status() int {
+	switch e.Code {
+	case fetchInvalidURL, fetchSchemeNotAllowed, fetchAddressBlocked, fetchTooManyRedirects, fetchTooLarge:
+		return http.StatusBadRequest
+	case fetchTimedOut:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+var errAddressBlocked = errors.New("the address is not public")
+
+// The ranges that are not covered by the methods on net.IP
+var blockedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),     // "this" network
+	mustParseCIDR("100.64.0.0/10"), // carrier grade NAT
+	mustParseCIDR("192.0.0.0/24"),  // IETF protocol assignments
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+	mustParseCIDR("64:ff9b::/96"),  // IPv4 translated into IPv6
+	mustParseCIDR("2001:db8::/32"), // documentation
+	mustParseCIDR("240.0.0.0/4"),   // reserved
+	mustParseCIDR("255.255.255.255/32"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// Returns true if the service is allowed to connect to the ip.
+// IPv4 addresses mapped into IPv6 are checked as IPv4, so blockedNetworks must not have ::ffff:0:0/96,
+// net.IPNet.Contains would match every IPv4 address with it.
+func isPublicIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// The client used for all track downloads. The address is checked when the connection is made,
+// after the name is resolved, so a host name can not point us to an internal address.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		// Proxies from the environment would connect for us and skip the check
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || (!fetchAllowPrivate && !isPublicIP(ip)) {
+					return &fetchError{fetchAddressBlocked, fmt.Errorf("%s: %w", host, errAddressBlocked)}
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > fetchMaxRedirects {
+			return &fetchError{fetchTooManyRedirects, fmt.Errorf("stopped after %d redirects", fetchMaxRedirects)}
+		}
+		return checkFetchURL(req.URL)
+	},
+}
+
+// Only http and https urls with a host are allowed
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &fetchError{fetchSchemeNotAllowed, fmt.Errorf("only http and https urls are allowed, not %q", u.Scheme)}
+	}
+	if u.Hostname() == "" {
+		return &fetchError{fetchInvalidURL, errors.New("the url has no host")}
+	}
+	return nil
+}
+
+// Downloads the igc file at the given url, within the limits above.
+// All errors are returned as a *fetchError.
+func fetchTrackContent(location string) (content []byte, err error) {
+	// Failed downloads are counted like failed ingestions
+	defer func() {
+		if err != nil {
+			countIngestFailure(err)
+		}
+	}()
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, &fetchError{fetchInvalidURL, err}
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &fetchError{fetchInvalidURL, err}
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, classifyFetchError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &fetchError{fetchBadStatus, fmt.Errorf("%s returned %s", u.Host, resp.Status)}
+	}
+	if resp.ContentLength > fetchMaxBytes {
+		return nil, &fetchError{fetchTooLarge, fmt.Errorf("the file is larger than %d bytes", fetchMaxBytes)}
+	}
+
+	// Reads one byte more than allowed, to know if the file is too large
+	content, err = ioutil.ReadAll(io.LimitReader(resp.Body, fetchMaxBytes+1))
+	if err != nil {
+		return nil, classifyFetchError(err)
+	}
+	if int64(len(content)) > fetchMaxBytes {
+		return nil, &fetchError{fetchTooLarge, fmt.Errorf("the file is larger than %d bytes", fetchMaxBytes)}
+	}
+	return content, nil
+}
+
+// Turns the errors from the http client into a *fetchError
+func classifyFetchError(err error) error {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &fetchError{fetchTimedOut, fmt.Errorf("no answer within %s", fetchTimeout)}
+	}
+	return &fetchError{fetchUnreachable, err}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	igc "github.com/marni/goigc"
 	"gopkg.in/mgo.v2/bson"
@@ -91,20 +94,70 @@ func getTrackLenght(s igc.Track) float64 {
 	return totalDistance
 }
 
-// This function should be called whenever something is added to the database to notify all registered webhooks
-func invokeWebhooks(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("###################INVOKING WEBHOOKS##########################")
-	webhooks, err := IGF.getAllWebhooks()
+// Returns the seconds from the first to the last fix of the track
+func getTrackDuration(s igc.Track) int64 {
+	if len(s.Points) < 2 {
+		return 0
+	}
+	duration := s.Points[len(s.Points)-1].Time.Sub(s.Points[0].Time)
+	// Flights over midnight UTC have their last fixes on the next day
+	if duration < 0 {
+		duration += 24 * time.Hour
+	}
+	return int64(duration / time.Second)
+}
+
+// Returns the key a name from an igc header is matched with. Case, punctuation and the order
+// of the words do not matter, so "Ola Nordmann" and "NORDMANN, OLA" are the same pilot.
+func nameKey(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// Returns the keys of the name and all the aliases, without duplicates
+func nameKeys(name string, aliases []string) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, n := range append([]string{name}, aliases...) {
+		if key := nameKey(n); key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// A notification waiting to be posted to a webhook
+type webhookDelivery struct {
+	Hook    Webhooks
+	Payload []byte
+	// The ID of the request that added the tracks, so the delivery can be found in the logs
+	RequestID string
+}
+
+// The notifications waiting to be posted, they are posted by runWebhookDispatcher.
+// applyConfig makes it with the size from the config.
+var webhookQueue chan webhookDelivery
+
+// This function should be called whenever something is added to the database to notify all registered webhooks.
+// It finds the webhooks with enough new tracks and puts their notifications in the queue,
+// so the caller does not have to wait for the webhooks to answer.
+func invokeWebhooks(ctx context.Context) error {
+	log := logFrom(ctx)
+	store := IGF.WithContext(ctx)
+	log.Debug("Invoking webhooks")
+	webhooks, err := store.getAllWebhooks()
 	if err != nil {
-		handleError(w, r, err, http.StatusBadRequest)
+		return err
 	}
 
 	//Finds the latest track to get the latest timestamp
-	track, err := IGF.FindLatest()
+	track, err := store.FindLatest()
 	if err != nil {
-		fmt.Println("FindLatest failed")
-		handleError(w, r, err, http.StatusBadRequest)
-		return
+		return err
 	}
 	for _, hook := range webhooks {
 		start := time.Now()
@@ -114,10 +167,9 @@ func invokeWebhooks(w http.ResponseWriter, r *http.Request) {
 			Processing time.Duration `json:"processing"`
 		}
 		// Finds the latest timestamp to compare with the timestamps stored in the webhooks
-		trackLatestArr, err := IGF.FindOldestByIdWebhook(int(hook.LatestKnownTrack))
+		trackLatestArr, err := store.FindOldestByIdWebhook(int(hook.LatestKnownTrack))
 		if err != nil {
-			handleError(w, r, err, http.StatusBadRequest)
-			return
+			return err
 		}
 		var trackks []int64
 		for i := 0; i < len(trackLatestArr); i++ {
@@ -136,30 +188,91 @@ func invokeWebhooks(w http.ResponseWriter, r *http.Request) {
 			Processing: time.Since(start) / time.Millisecond,
 		}
 		// Checks if there has been enough changes to trigget the webhook
-		if sliceLength > hook.MinTriggerValue {
-			// Makes the string to send to the webhook
-			payload := "Latest timestamp: " + strconv.Itoa(int(returnSt.Latest)) + ", " + strconv.Itoa(len(trackksID)) + " new tracks are: "
-			for _, track := range returnSt.Tracks {
-				payload = fmt.Sprintf("%s, %s", payload, track)
-			}
-			payload = fmt.Sprintf("%s. (processing %dms)", payload, returnSt.Processing)
+		if sliceLength <= hook.MinTriggerValue {
+			log.Debug("minTriggerValue not high enough", "webhook", hook.ID.Hex())
+			continue
+		}
+		// Makes the string to send to the webhook
+		payload := "Latest timestamp: " + strconv.Itoa(int(returnSt.Latest)) + ", " + strconv.Itoa(len(trackksID)) + " new tracks are: "
+		for _, track := range returnSt.Tracks {
+			payload = fmt.Sprintf("%s, %s", payload, track)
+		}
+		payload = fmt.Sprintf("%s. (processing %dms)", payload, returnSt.Processing)
 
-			// puts the string into a struct to encode
-			type returnContent struct {
-				Payload string `json:"content"`
-			}
+		// puts the string into a struct to encode
+		type returnContent struct {
+			Payload string `json:"content"`
+		}
+
+		payloadStruct := returnContent{payload}
+		teemo, _ := json.Marshal(payloadStruct)
+
+		// updates the latest known timestamp in the webhook to the newest in the database,
+		// before it is posted, so the same tracks are not sent twice while it waits in the queue
+		NowLatest := track.Timestamp
+		db.C(WEBHOOKS).Update(bson.M{"_id": hook.ID}, bson.M{"$set": bson.M{"latestKnownTrack": NowLatest}})
 
-			payloadStruct := returnContent{payload}
-			teemo, _ := json.Marshal(payloadStruct)
-			// Posts the webhook to discord
-			_, err = http.Post(hook.WebhookURL, "application/json", bytes.NewBuffer(teemo))
-			NowLatest := track.Timestamp
-			// updates the latest known timestamp in the webhook to the newest in the database when invoked
-			db.C(WEBHOOKS).Update(bson.M{"_id": hook.ID}, bson.M{"$set": bson.M{"latestKnownTrack": NowLatest}})
-		} else {
-			fmt.Println("minTriggerValue not high enough")
-			return
+		select {
+		case webhookQueue <- webhookDelivery{Hook: hook, Payload: teemo, RequestID: requestIDFrom(ctx)}:
+			log.Info("Webhook notification queued", "webhook", hook.ID.Hex(), "tracks", len(trackksID))
+		default:
+			log.Warn("Webhook queue is full, dropping notification", "webhook", hook.ID.Hex())
+			webhookDeliveries.WithLabelValues("dropped").Inc()
 		}
 	}
+	return nil
+}
+
+// The client used to post webhooks. The timeout from the config keeps a slow webhook
+// from holding up the others, and from holding up the shutdown.
+var webhookClient = &http.Client{}
 
+// Closed by shutdown to make runWebhookDispatcher post what is left in the queue and stop
+var stopWebhooks = make(chan struct{})
+
+// Closed by runWebhookDispatcher when it has stopped
+var webhooksStopped = make(chan struct{})
+
+// Posts the notifications in the webhook queue, one at a time, until the program shuts down
+func runWebhookDispatcher() {
+	dispatcherRunning.Store(true)
+	defer close(webhooksStopped)
+	defer dispatcherRunning.Store(false)
+	for {
+		select {
+		case delivery := <-webhookQueue:
+			deliverWebhook(delivery)
+		case <-stopWebhooks:
+			// Posts the notifications that are still waiting before stopping
+			for {
+				select {
+				case delivery := <-webhookQueue:
+					deliverWebhook(delivery)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Posts one notification to its webhook
+func deliverWebhook(delivery webhookDelivery) {
+	log := logFrom(contextWithRequestID(delivery.RequestID)).With("webhook", delivery.Hook.ID.Hex())
+	// Posts the webhook to discord
+	start := time.Now()
+	resp, err := webhookClient.Post(delivery.Hook.WebhookURL, "application/json", bytes.NewBuffer(delivery.Payload))
+	if err != nil {
+		log.Warn("Posting webhook failed", "err", err)
+		webhookDeliveries.WithLabelValues("failed").Inc()
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warn("Webhook rejected the notification", "status", resp.StatusCode)
+		webhookDeliveries.WithLabelValues("rejected").Inc()
+		return
+	}
+	webhookDeliveries.WithLabelValues("delivered").Inc()
+	log.Info("Webhook delivered", "status", resp.StatusCode, "duration_ms", time.Since(start).Milliseconds())
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	igc "github.com/marni/goigc"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The path of a track as a GeoJSON LineString, with [longitude, latitude] coordinates.
+// It has a 2dsphere index, so tracks can be found by where they were flown.
+type TrackPath struct {
+	Type        string      `bson:"type" json:"type"`
+	Coordinates [][]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+const (
+	// The fixes in the path are at least this many metres apart, so a long flight is not thousands of points
+	trackPathStep = 100.0
+	// The radius in kilometres of ?near= when ?radius= is not given
+	nearDefaultRadius = 5.0
+	// The edges of a ?bbox= get a point every this many degrees,
+	// since mongodb draws the edges as great circles and not along the latitude
+	bboxEdgeStep = 1.0
+)
+
+// Returns the path of the track, or nil if the track does not move, since a
+// GeoJSON LineString needs two different positions
+func getTrackPath(s igc.Track) *TrackPath {
+	coordinates := [][]float64{}
+	var last igc.Point
+	for i, p := range s.Points {
+		distance := 0.0
+		if len(coordinates) > 0 {
+			distance = last.Distance(p) * 1000
+		}
+		end := i == len(s.Points)-1
+		if len(coordinates) == 0 || distance >= trackPathStep || (end && distance > 0) {
+			coordinates = append(coordinates, []float64{p.Lng.Degrees(), p.Lat.Degrees()})
+			last = p
+		}
+	}
+	if len(coordinates) < 2 {
+		return nil
+	}
+	return &TrackPath{"LineString", coordinates}
+}
+
+// Reads ?near=lat,lon and ?radius=km, and returns the condition on the path
+// of the tracks that come within the radius of the point
+func nearQuery(near string, radius string) (bson.M, error) {
+	parts := strings.Split(near, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("near must be lat,lon")
+	}
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, errLon := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errLat != nil || errLon != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return nil, fmt.Errorf("near must be lat,lon in decimal degrees")
+	}
+	km := nearDefaultRadius
+	if radius != "" {
+		var err error
+		km, err = strconv.ParseFloat(radius, 64)
+		if err != nil || km <= 0 {
+			return nil, fmt.Errorf("radius must be a positive number of kilometres")
+		}
+	}
+	return bson.M{"$nearSphere": bson.M{
+		"$geometry":    bson.M{"type": "Point", "coordinates": []float64{lon, lat}},
+		"$maxDistance": km * 1000,
+	}}, nil
+}
+
+// Reads ?bbox=minLon,minLat,maxLon,maxLat, and returns the condition on the path
+// of the tracks that go through the box. Boxes over the antimeridian are not supported.
+func bboxQuery(bbox string) (bson.M, error) {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat in decimal degrees")
+		}
+		values[i] = value
+	}
+	minLon, minLat, maxLon, maxLat := values[0], values[1], values[2], values[3]
+	if minLon < -180 || maxLon > 180 || minLat < -90 || maxLat > 90 || minLon >= maxLon || minLat >= maxLat {
+		return nil, fmt.Errorf("bbox must have minLon < maxLon and minLat < maxLat within -180,-90,180,90")
+	}
+	// The east and west edges would be the same meridian
+	if maxLon-minLon >= 360 {
+		return nil, fmt.Errorf("bbox must be less than 360 degrees wide")
+	}
+
+	// Goes around the box counter clockwise: east along the south edge, north along the east edge,
+	// west along the north edge and back south along the west edge.
+	// The east and west edges get points too, so an edge from pole to pole is not ambiguous.
+	ring := [][]float64{}
+	for lon := minLon; lon < maxLon; lon += bboxEdgeStep {
+		ring = appendRingPoint(ring, lon, minLat)
+	}
+	for lat := minLat; lat < maxLat; lat += bboxEdgeStep {
+		ring = appendRingPoint(ring, maxLon, lat)
+	}
+	for lon := maxLon; lon > minLon; lon -= bboxEdgeStep {
+		ring = appendRingPoint(ring, lon, maxLat)
+	}
+	for lat := maxLat; lat > minLat; lat -= bboxEdgeStep {
+		ring = appendRingPoint(ring, minLon, lat)
+	}
+	ring = append(ring, ring[0])
+
+	// Without the strict winding crs mongodb takes the smaller of the two areas the ring splits
+	// the earth into, which is the wrong one for boxes wider than half the earth
+	return bson.M{"$geoIntersects": bson.M{
+		"$geometry": bson.M{
+			"type":        "Polygon",
+			"coordinates": [][][]float64{ring},
+			"crs": bson.M{
+				"type":       "name",
+				"properties": bson.M{"name": "urn:x-mongodb:crs:strictwinding:EPSG:4326"},
+			},
+		},
+	}}, nil
+}
+
+// Adds the point to the ring, unless it is the same as the last point.
+// Every point on a pole is the same point whatever the longitude, and mongodb
+// does not accept a ring with the same point twice in a row.
+func appendRingPoint(ring [][]float64, lon float64, lat float64) [][]float64 {
+	if len(ring) > 0 {
+		last := ring[len(ring)-1]
+		if last[1] == lat && (last[0] == lon || math.Abs(lat) == 90) {
+			return ring
+		}
+	}
+	return append(ring, []float64{lon, lat})
+}
+
+// Calculates the path of the tracks stored before it was calculated at ingestion.
+// It is run once when the program has connected to the database.
+func (m *IgcFiles) backfillTrackPaths() {
+	var tracks []Track
+	err := db.C(COLLECTION).Find(bson.M{"path": bson.M{"$exists": false}}).Select(bson.M{"_id": 1}).All(&tracks)
+	if err != nil {
+		m.logger().Error("Finding the tracks without a path failed", "err", err)
+		return
+	}
+	if len(tracks) == 0 {
+		return
+	}
+	for _, track := range tracks {
+		m.backfillTrack(&track)
+	}
+	m.logger().Info("Calculated the path of stored tracks", "tracks", len(tracks))
+}
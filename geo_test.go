@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns the ring and the crs of the polygon in a bbox condition
+func bboxRing(t *testing.T, bbox string) ([][]float64, string) {
+	t.Helper()
+	query, err := bboxQuery(bbox)
+	if err != nil {
+		t.Fatalf("bboxQuery(%q) failed: %v", bbox, err)
+	}
+	geometry := query["$geoIntersects"].(bson.M)["$geometry"].(bson.M)
+	crs := geometry["crs"].(bson.M)["properties"].(bson.M)["name"].(string)
+	return geometry["coordinates"].([][][]float64)[0], crs
+}
+
+// Checks that the ring is closed, has no point twice in a row and at most one point on each pole
+func checkRing(t *testing.T, bbox string, ring [][]float64) {
+	t.Helper()
+	if len(ring) < 4 {
+		t.Fatalf("%s: the ring has %d points, a polygon needs 4", bbox, len(ring))
+	}
+	first, last := ring[0], ring[len(ring)-1]
+	if first[0] != last[0] || first[1] != last[1] {
+		t.Errorf("%s: the ring is not closed, %v and %v", bbox, first, last)
+	}
+	poles := map[float64]int{}
+	for i, p := range ring[:len(ring)-1] {
+		if math.Abs(p[1]) == 90 {
+			poles[p[1]]++
+		}
+		next := ring[i+1]
+		if p[0] == next[0] && p[1] == next[1] {
+			t.Errorf("%s: %v is twice in a row", bbox, p)
+		}
+	}
+	for lat, n := range poles {
+		if n > 1 {
+			t.Errorf("%s: the pole at %v is in the ring %d times", bbox, lat, n)
+		}
+	}
+}
+
+func TestBboxQuery(t *testing.T) {
+	tests := []string{
+		"6.0,60.4,6.8,60.7",
+		// Wider than half the earth
+		"-170,-10,170,10",
+		// Touching a pole
+		"0,80,10,90",
+		"-30,-90,30,-60",
+		// From pole to pole
+		"0,-90,10,90",
+		"-179.5,-90,179.5,90",
+	}
+	for _, bbox := range tests {
+		ring, crs := bboxRing(t, bbox)
+		checkRing(t, bbox, ring)
+		// The strict winding crs makes mongodb use the inside of the ring even when it is the bigger area
+		if crs != "urn:x-mongodb:crs:strictwinding:EPSG:4326" {
+			t.Errorf("%s: the crs is %s", bbox, crs)
+		}
+	}
+}
+
+func TestBboxQueryCounterClockwise(t *testing.T) {
+	ring, _ := bboxRing(t, "-170,-10,170,10")
+	// The first edge goes east along the south edge, so the box is on the left
+	if ring[1][0] <= ring[0][0] || ring[1][1] != -10 {
+		t.Errorf("the ring starts %v, %v, not east along the south edge", ring[0], ring[1])
+	}
+}
+
+func TestBboxQueryInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"1,2,3",
+		"a,b,c,d",
+		// min must be less than max
+		"10,0,0,10",
+		"0,10,10,0",
+		"0,0,0,10",
+		// Out of range
+		"-181,0,0,10",
+		"0,-91,10,0",
+		"0,0,10,91",
+		// The east and west edges would be the same meridian
+		"-180,-10,180,10",
+	}
+	for _, bbox := range tests {
+		if _, err := bboxQuery(bbox); err == nil {
+			t.Errorf("bboxQuery(%q) did not fail", bbox)
+		}
+	}
+}
+
+func TestNearQuery(t *testing.T) {
+	query, err := nearQuery("60.565, 6.425", "")
+	if err != nil {
+		t.Fatalf("nearQuery failed: %v", err)
+	}
+	near := query["$nearSphere"].(bson.M)
+	point := near["$geometry"].(bson.M)["coordinates"].([]float64)
+	// GeoJSON has the longitude first
+	if point[0] != 6.425 || point[1] != 60.565 {
+		t.Errorf("the point is %v, want [6.425 60.565]", point)
+	}
+	if near["$maxDistance"] != nearDefaultRadius*1000 {
+		t.Errorf("the default distance is %v metres", near["$maxDistance"])
+	}
+
+	query, err = nearQuery("60.565,6.425", "10")
+	if err != nil {
+		t.Fatalf("nearQuery with a radius failed: %v", err)
+	}
+	if distance := query["$nearSphere"].(bson.M)["$maxDistance"]; distance != 10000.0 {
+		t.Errorf("the distance is %v metres, want 10000", distance)
+	}
+
+	for _, params := range [][2]string{
+		{"60.565", ""},
+		{"a,b", ""},
+		{"91,6", ""},
+		{"60,181", ""},
+		{"60,6", "0"},
+		{"60,6", "-1"},
+		{"60,6", "far"},
+	} {
+		if _, err := nearQuery(params[0], params[1]); err == nil {
+			t.Errorf("nearQuery(%q, %q) did not fail", params[0], params[1])
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The certification classes a glider can have, EN 926-2 and the older German LTF
+var gliderClasses = map[string]bool{
+	"EN-A":    true,
+	"EN-B":    true,
+	"EN-C":    true,
+	"EN-D":    true,
+	"CCC":     true,
+	"LTF-1":   true,
+	"LTF-1/2": true,
+	"LTF-2":   true,
+	"LTF-2/3": true,
+	"LTF-3":   true,
+}
+
+// Returns the class as it is stored, so "en b" and "EN-B" are the same class.
+// Returns false if it is not a known class.
+func normalizeGliderClass(class string) (string, bool) {
+	class = strings.ToUpper(strings.TrimSpace(class))
+	class = strings.Join(strings.Fields(class), "-")
+	return class, gliderClasses[class]
+}
+
+// Returns the name of the glider as it is usually written in igc headers, e.g. "Ozone Rush 5 MS"
+func (g Glider) FullName() string {
+	return strings.Join(strings.Fields(g.Manufacturer+" "+g.Model+" "+g.Size), " ")
+}
+
+// Returns the id of the glider in the registry the track should be linked to,
+// or "" if no glider has the name
+func (m *IgcFiles) gliderRefForName(name string) string {
+	var glider Glider
+	if err := m.findByName(gliderRegistry, name, &glider); err != nil {
+		return ""
+	}
+	return glider.ID.Hex()
+}
+
+// Returns the ids of all gliders in the class, used to filter tracks by class.
+// The class must be normalized with normalizeGliderClass first.
+func (m *IgcFiles) gliderRefsInClass(class string) ([]string, error) {
+	gliders, err := m.FindAllGliders(bson.M{"class": class})
+	if err != nil {
+		return nil, err
+	}
+	refs := []string{}
+	for _, glider := range gliders {
+		refs = append(refs, glider.ID.Hex())
+	}
+	return refs, nil
+}
+
+// This function inserts a new glider into the registry
+func (m *IgcFiles) InsertGlider(glider Glider) error {
+	return db.C(GLIDERS).Insert(&glider)
+}
+
+// This function returns the gliders matching the query sorted by name
+func (m *IgcFiles) FindAllGliders(query bson.M) ([]Glider, error) {
+	var gliders []Glider
+	err := db.C(GLIDERS).Find(query).Sort("manufacturer", "model", "size").All(&gliders)
+	return gliders, err
+}
+
+// This function finds the glider with the given id
+func (m *IgcFiles) FindGlider(id string) (Glider, error) {
+	var glider Glider
+	err := db.C(GLIDERS).FindId(bson.ObjectIdHex(id)).One(&glider)
+	return glider, err
+}
+
+// The statistics of one glider, from all the tracks flown with it
+type GliderStats struct {
+	Flights int `json:"total_flights"`
+	// The mean glide ratio of the flights that had glides
+	GlideRatio float64 `json:"average_glide_ratio"`
+	// The mean length in kilometres of the tracks, the sum of the distances between the fixes.
+	// It is not the XC distance of the flights, which is usually shorter.
+	TrackLength float64 `json:"average_track_length"`
+	// The highest speed in km/h of any flight
+	MaxSpeed float64 `json:"max_speed"`
+}
+
+// Calculates the statistics of the glider from its tracks.
+// Tracks stored before the performance was calculated get it from their igc file, see backfillTrack.
+func (m *IgcFiles) GliderStats(id string) (GliderStats, error) {
+	var stats GliderStats
+	tracks, err := m.FindAll(bson.M{"glider_ref": id})
+	if err != nil {
+		return stats, err
+	}
+	glides := 0
+	for _, track := range tracks {
+		if track.Performance == nil {
+			m.backfillTrack(&track)
+		}
+		stats.Flights++
+		stats.TrackLength += track.TrackLenght
+		if track.Performance == nil {
+			continue
+		}
+		if track.Performance.GlideRatio > 0 {
+			glides++
+			stats.GlideRatio += track.Performance.GlideRatio
+		}
+		if track.Performance.MaxSpeed > stats.MaxSpeed {
+			stats.MaxSpeed = track.Performance.MaxSpeed
+		}
+	}
+	if stats.Flights > 0 {
+		stats.TrackLength /= float64(stats.Flights)
+	}
+	if glides > 0 {
+		stats.GlideRatio /= float64(glides)
+	}
+	return stats, nil
+}
+
+// The fields of a glider that can be sent when it is created or changed
+type gliderParams struct {
+	Manufacturer *string   `json:"manufacturer"`
+	Model        *string   `json:"model"`
+	Size         *string   `json:"size"`
+	Class        *string   `json:"class"`
+	Aliases      *[]string `json:"aliases"`
+}
+
+// Returns all gliders, or only the ones in ?class=
+func handleGetParaglidingAPIGliders(w http.ResponseWriter, r *http.Request) {
+	query := bson.M{}
+	if class := r.URL.Query().Get("class"); class != "" {
+		normalized, ok := normalizeGliderClass(class)
+		if !ok {
+			handleError(w, r, fmt.Errorf("unknown glider class %q", class), http.StatusBadRequest)
+			return
+		}
+		query["class"] = normalized
+	}
+	gliders, err := IGF.For(r).FindAllGliders(query)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if gliders == nil {
+		gliders = []Glider{}
+	}
+	JsonStringResponse(w, http.StatusOK, gliders)
+}
+
+// Adds a glider to the registry and links the tracks flown with it
+func handlePostParaglidingAPIGliders(w http.ResponseWriter, r *http.Request) {
+	var params gliderParams
+	if err := decodeNamedParams(r, &params); err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if params.Manufacturer == nil || strings.TrimSpace(*params.Manufacturer) == "" {
+		handleError(w, r, fmt.Errorf("manufacturer is required"), http.StatusBadRequest)
+		return
+	}
+	if params.Model == nil || strings.TrimSpace(*params.Model) == "" {
+		handleError(w, r, fmt.Errorf("model is required"), http.StatusBadRequest)
+		return
+	}
+	if params.Class == nil {
+		handleError(w, r, fmt.Errorf("class is required"), http.StatusBadRequest)
+		return
+	}
+	class, ok := normalizeGliderClass(*params.Class)
+	if !ok {
+		handleError(w, r, fmt.Errorf("unknown glider class %q", *params.Class), http.StatusBadRequest)
+		return
+	}
+
+	glider := Glider{
+		ID:           bson.NewObjectId(),
+		Manufacturer: strings.TrimSpace(*params.Manufacturer),
+		Model:        strings.TrimSpace(*params.Model),
+		Class:        class,
+		Aliases:      []string{},
+		Created:      time.Now().UTC(),
+	}
+	if params.Size != nil {
+		glider.Size = strings.TrimSpace(*params.Size)
+	}
+	if params.Aliases != nil {
+		glider.Aliases = cleanAliases(*params.Aliases)
+	}
+	glider.NameKeys = nameKeys(glider.FullName(), glider.Aliases)
+
+	store := IGF.For(r)
+	if err := store.InsertGlider(glider); err != nil {
+		if mgo.IsDup(err) {
+			nameTaken(w, r, gliderRegistry)
+			return
+		}
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := store.linkNamedTracks(gliderRegistry, glider.ID, glider.NameKeys); err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/paragliding/api/gliders/"+glider.ID.Hex())
+	JsonStringResponse(w, http.StatusCreated, glider)
+}
+
+// Returns the glider with the given ID and its statistics
+func handleGetParaglidingAPIGliderID(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	store := IGF.For(r)
+	glider, err := store.FindGlider(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	stats, err := store.GliderStats(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	type returnVal struct {
+		Glider
+		GliderStats
+	}
+	JsonStringResponse(w, http.StatusOK, returnVal{glider, stats})
+}
+
+// Changes the glider with the given ID. Only the fields in the body are changed.
+// If the name or aliases change the tracks are linked again.
+func handlePatchParaglidingAPIGliderID(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	var params gliderParams
+	if err := decodeNamedParams(r, &params); err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	store := IGF.For(r)
+	glider, err := store.FindGlider(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	set := bson.M{}
+	if params.Manufacturer != nil {
+		if strings.TrimSpace(*params.Manufacturer) == "" {
+			handleError(w, r, fmt.Errorf("manufacturer can not be empty"), http.StatusBadRequest)
+			return
+		}
+		glider.Manufacturer = strings.TrimSpace(*params.Manufacturer)
+		set["manufacturer"] = glider.Manufacturer
+	}
+	if params.Model != nil {
+		if strings.TrimSpace(*params.Model) == "" {
+			handleError(w, r, fmt.Errorf("model can not be empty"), http.StatusBadRequest)
+			return
+		}
+		glider.Model = strings.TrimSpace(*params.Model)
+		set["model"] = glider.Model
+	}
+	if params.Size != nil {
+		glider.Size = strings.TrimSpace(*params.Size)
+		set["size"] = glider.Size
+	}
+	if params.Class != nil {
+		class, ok := normalizeGliderClass(*params.Class)
+		if !ok {
+			handleError(w, r, fmt.Errorf("unknown glider class %q", *params.Class), http.StatusBadRequest)
+			return
+		}
+		set["class"] = class
+	}
+	if params.Aliases != nil {
+		glider.Aliases = cleanAliases(*params.Aliases)
+		set["aliases"] = glider.Aliases
+	}
+	if len(set) == 0 {
+		handleError(w, r, fmt.Errorf("nothing to update"), http.StatusBadRequest)
+		return
+	}
+	set["name_keys"] = nameKeys(glider.FullName(), glider.Aliases)
+
+	if err := store.updateByID(gliderRegistry, tmp, set, &glider); err != nil {
+		if mgo.IsDup(err) {
+			nameTaken(w, r, gliderRegistry)
+			return
+		}
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if params.Manufacturer != nil || params.Model != nil || params.Size != nil || params.Aliases != nil {
+		if err := store.linkNamedTracks(gliderRegistry, glider.ID, glider.NameKeys); err != nil {
+			handleError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	JsonStringResponse(w, http.StatusOK, glider)
+}
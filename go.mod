@@ -1,8 +1,23 @@
 module github.com/eplejuice/paragliding
 
+go 1.22
+
 require (
 	github.com/marni/goigc v0.1.0
+	github.com/prometheus/client_golang v1.19.1
 	github.com/robfig/cron v0.0.0-20180505203441-b41be1df6967
 	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
-	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5 // indirect
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/geo v0.0.0-20170803022016-284d0e782614 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
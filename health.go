@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Set when the database is connected and db can be used
+var storeConnected atomic.Bool
+
+// Set while runWebhookDispatcher is posting notifications
+var dispatcherRunning atomic.Bool
+
+// The waits between tries to connect to the database
+const (
+	connectBackoffMin = time.Second
+	connectBackoffMax = time.Minute
+)
+
+// Tries to connect to the database until it works, waiting longer after every failure
+func connectWithBackoff() {
+	wait := connectBackoffMin
+	for {
+		logger.Info("Connecting to database")
+		err := IGF.Connect()
+		if err == nil {
+			logger.Info("Connection success")
+			return
+		}
+		logger.Warn("Connecting to database failed", "retry_in", wait.String(), "err", err)
+		time.Sleep(wait)
+		wait *= 2
+		if wait > connectBackoffMax {
+			wait = connectBackoffMax
+		}
+	}
+}
+
+// Answers 503 until the database is connected, the handlers need it
+func withStore(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !storeConnected.Load() {
+			w.Header().Set("Retry-After", "5")
+			writeError(w, r, &apiError{http.StatusServiceUnavailable, "store_unavailable", "the database is not connected yet", nil})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// The result of one readiness check
+type healthCheck struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms,omitempty"`
+	Depth     *int   `json:"depth,omitempty"`
+	Capacity  int    `json:"capacity,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// Returns 200 as long as the process can answer, it does not look at the database
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	JsonStringResponse(w, http.StatusOK, healthResponse{Status: "ok", Uptime: calcTime(startTime)})
+}
+
+// Returns 200 when the service can handle requests, and 503 with the failed checks when it can not
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{
+		"shutdown":           {OK: !shuttingDown.Load()},
+		"store":              checkStore(),
+		"webhook_dispatcher": {OK: dispatcherRunning.Load()},
+		"webhook_queue":      checkQueue(len(webhookQueue), cap(webhookQueue)),
+		"job_queue":          checkQueue(len(jobQueue), cap(jobQueue)),
+	}
+	response := healthResponse{Status: "ok", Uptime: calcTime(startTime), Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	JsonStringResponse(w, status, response)
+}
+
+// Pings the database
+func checkStore() healthCheck {
+	if !storeConnected.Load() {
+		return healthCheck{Error: "not connected"}
+	}
+	start := time.Now()
+	session := db.Session.Copy()
+	defer session.Close()
+	if err := session.Ping(); err != nil {
+		// Makes the next operations get a new connection instead of the broken one
+		db.Session.Refresh()
+		return healthCheck{Error: err.Error()}
+	}
+	return healthCheck{OK: true, LatencyMs: time.Since(start).Milliseconds()}
+}
+
+// A queue is saturated when it is full, then new items are refused or dropped
+func checkQueue(depth int, capacity int) healthCheck {
+	check := healthCheck{OK: depth < capacity, Depth: &depth, Capacity: capacity}
+	if !check.OK {
+		check.Error = "queue is full"
+	}
+	return check
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The largest ZIP archive that can be imported at once, in bytes
+var importMaxBytes int64
+
+// The status of one file in a bulk import
+const (
+	importCreated   = "created"
+	importDuplicate = "duplicate"
+	importFailed    = "error"
+	importSkipped   = "skipped"
+)
+
+// The result of importing one file from the archive
+type importFileResult struct {
+	File   string `bson:"file" json:"file"`
+	Status string `bson:"status" json:"status"`
+	ID     string `bson:"id,omitempty" json:"id,omitempty"`
+	Error  string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+type importReport struct {
+	Created    int                `bson:"created" json:"created"`
+	Duplicates int                `bson:"duplicates" json:"duplicates"`
+	Errors     int                `bson:"errors" json:"errors"`
+	Files      []importFileResult `bson:"files" json:"files"`
+}
+
+// Imports every .igc file in a ZIP archive, the same way as a track posted with a url.
+// The files are owned by the key that imports them.
+func importArchive(ctx context.Context, archive []byte, key APIKey) (importReport, error) {
+	report := importReport{Files: []importFileResult{}}
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return report, err
+	}
+
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		result := importFileResult{File: file.Name}
+		if !strings.EqualFold(path.Ext(file.Name), ".igc") {
+			result.Status = importSkipped
+			report.Files = append(report.Files, result)
+			continue
+		}
+
+		track, duplicate, err := importArchiveFile(ctx, file, key)
+		switch {
+		case err != nil:
+			result.Status = importFailed
+			result.Error = err.Error()
+			report.Errors++
+		case duplicate:
+			result.Status = importDuplicate
+			result.ID = track.ID.Hex()
+			report.Duplicates++
+		default:
+			result.Status = importCreated
+			result.ID = track.ID.Hex()
+			report.Created++
+		}
+		report.Files = append(report.Files, result)
+	}
+	return report, nil
+}
+
+// Reads one file from the archive and stores it as a track.
+// Files larger than fetchMaxBytes, the same limit as for downloaded tracks, are not read.
+func importArchiveFile(ctx context.Context, file *zip.File, key APIKey) (Track, bool, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return Track{}, false, err
+	}
+	defer rc.Close()
+	// The size in the archive can be wrong, so the file is also cut off while it is read.
+	// A small archive can unpack to a huge file, one byte more than allowed tells it is too large.
+	tooLarge := fmt.Errorf("the file is larger than %d bytes unpacked", fetchMaxBytes)
+	if file.UncompressedSize64 > uint64(fetchMaxBytes) {
+		return Track{}, false, tooLarge
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(rc, fetchMaxBytes+1))
+	if err != nil {
+		return Track{}, false, err
+	}
+	if int64(len(content)) > fetchMaxBytes {
+		return Track{}, false, tooLarge
+	}
+	return ingestTrack(ctx, content, file.Name, key)
+}
+
+// Imports a ZIP archive of igc files sent as the body,
+// and returns a report with the result for every file
+func handlePostAdminApiImportIgc(w http.ResponseWriter, r *http.Request) {
+	key, _ := requestKey(r)
+
+	// Reads one byte more than allowed, to know if the archive is too large
+	defer r.Body.Close()
+	archive, err := ioutil.ReadAll(io.LimitReader(r.Body, importMaxBytes+1))
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if int64(len(archive)) > importMaxBytes {
+		handleError(w, r, fmt.Errorf("the archive is larger than %d bytes", importMaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// With ?async=true the archive is imported by a worker, and the report is put on the job
+	if r.URL.Query().Get("async") == "true" {
+		job, err := enqueueJob(r.Context(), jobArchive, "", archive, key)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if err == errQueueFull {
+				status = http.StatusServiceUnavailable
+			}
+			handleError(w, r, err, status)
+			return
+		}
+		respondJobAccepted(w, job)
+		return
+	}
+
+	report, err := importArchive(r.Context(), archive, key)
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	JsonStringResponse(w, http.StatusOK, report)
+
+	// Notifies all registered webhooks once for the whole import
+	if report.Created > 0 {
+		if err := invokeWebhooks(r.Context()); err != nil {
+			logFrom(r.Context()).Error("Invoking webhooks failed", "err", err)
+		}
+	}
+}
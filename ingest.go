@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	igc "github.com/marni/goigc"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// When true the G-record (the signature of the flight recorder) is part of the content hash,
+// so the same flight signed twice is not a duplicate
+var hashIncludeGRecord bool
+
+// Returns a hex encoded sha256 hash over the B-records (the fixes) of an igc file.
+// The records are trimmed and uppercased first, so line endings and
+// whitespace do not make two copies of the same flight look different.
+func contentHash(content string) string {
+	hash := sha256.New()
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.ToUpper(strings.TrimSpace(line))
+		if line == "" {
+			continue
+		}
+		if line[0] == 'B' || (hashIncludeGRecord && line[0] == 'G') {
+			hash.Write([]byte(line))
+			hash.Write([]byte{'\n'})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// A mutex to lock/unlock the timestamp as a critical sector, to avoid duplicates
+var mutex = &sync.Mutex{}
+
+// The last timestamp given to a track
+var lastTimestamp int64
+
+// Creates a unique monotone timestamp in milliseconds for a new track.
+// If two tracks are added in the same millisecond the second one gets the next millisecond.
+func newTimestamp() int64 {
+	// Locks the critical sector so only one timestamp can be created at a time
+	mutex.Lock()
+	defer mutex.Unlock()
+	uniq := time.Now().UnixNano() / int64(time.Millisecond)
+	if uniq <= lastTimestamp {
+		uniq = lastTimestamp + 1
+	}
+	lastTimestamp = uniq
+	return uniq
+}
+
+// Parses an igc file, calculates its statistics and stores it as a new track owned by the key.
+// source is where the file came from, which is the url for tracks posted with a url.
+// If the flight is already stored the existing track is returned with duplicate set to true.
+func ingestTrack(ctx context.Context, content []byte, source string, key APIKey) (track Track, duplicate bool, err error) {
+	store := IGF.WithContext(ctx)
+	defer func() {
+		switch {
+		case err != nil:
+			countIngestFailure(err)
+			logFrom(ctx).Warn("Ingesting track failed", "source", source, "err", err)
+		case duplicate:
+			ingestTotal.WithLabelValues("duplicate").Inc()
+			logFrom(ctx).Info("Track is a duplicate", "source", source, "track", track.ID.Hex())
+		default:
+			ingestTotal.WithLabelValues("created").Inc()
+			logFrom(ctx).Info("Track created", "source", source, "track", track.ID.Hex())
+		}
+	}()
+
+	// Checks if the file is an igcfile using the marni/goigc library
+	parseStart := time.Now()
+	tmpTrack, err := igc.Parse(string(content))
+	igcParseDuration.Observe(time.Since(parseStart).Seconds())
+	if err != nil {
+		return track, false, &apiError{http.StatusUnprocessableEntity, "invalid_igc", err.Error(), nil}
+	}
+
+	hash := contentHash(string(content))
+	if existing, err := store.FindByHash(hash); err == nil {
+		return existing, true, nil
+	} else if err != mgo.ErrNotFound {
+		return track, false, err
+	}
+
+	performance := getTrackPerformance(tmpTrack)
+	takeoff, landing := getTrackEnds(tmpTrack)
+	// The struct used to put data into the database
+	track = Track{
+		ID:          bson.NewObjectId(),
+		Timestamp:   newTimestamp(),
+		Url:         source,
+		HDate:       tmpTrack.Header.Date,
+		Pilot:       tmpTrack.Pilot,
+		Glider:      tmpTrack.GliderType,
+		GliderID:    tmpTrack.GliderID,
+		TrackLenght: getTrackLenght(tmpTrack),
+		Duration:    getTrackDuration(tmpTrack),
+		PilotID:     store.pilotIDForName(tmpTrack.Pilot),
+		GliderRef:   store.gliderRefForName(tmpTrack.GliderType),
+		Performance: &performance,
+		Takeoff:     takeoff,
+		Landing:     landing,
+		Path:        getTrackPath(tmpTrack),
+		Owner:       key.Name,
+		ContentHash: hash,
+		Validation:  validateTrack(tmpTrack),
+	}
+	if key.ID != "" {
+		track.OwnerKey = key.ID.Hex()
+	}
+	store.tagTrackSites(&track)
+
+	// Inserts the object into the database with the Insert function from main.go
+	if err := store.Insert(track); err != nil {
+		// Another request can have inserted the same flight since the check above
+		if mgo.IsDup(err) {
+			if existing, err := store.FindByHash(hash); err == nil {
+				return existing, true, nil
+			}
+		}
+		return Track{}, false, err
+	}
+	// Keeps the igc file itself so it is part of exports.
+	// The track is usable without it, so a failure is only logged.
+	if err := store.InsertContent(track.ID, content); err != nil {
+		logFrom(ctx).Warn("Storing the igc file failed", "track", track.ID.Hex(), "err", err)
+	}
+	return track, false, nil
+}
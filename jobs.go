@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The kinds of jobs
+const (
+	jobTrack   = "track"
+	jobArchive = "archive"
+)
+
+// The states a job goes through
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// The number of jobs processed at the same time, and how many can wait in the queue
+// They are set by applyConfig, which also makes the queue.
+var ingestWorkers int
+
+var errQueueFull = errors.New("the job queue is full, try again later")
+
+// A job waiting in the queue. The archive is only kept in memory,
+// so queued archive jobs are lost if the program stops.
+type jobTask struct {
+	Job     Job
+	Archive []byte
+	Key     APIKey
+}
+
+// Returns a context with the ID of the request that created the job
+func (t jobTask) context() context.Context {
+	return contextWithRequestID(t.Job.RequestID)
+}
+
+var jobQueue chan jobTask
+
+// This function inserts a new job into the database
+func (m *IgcFiles) InsertJob(job Job) error {
+	return db.C(JOBS).Insert(&job)
+}
+
+// This function finds the job with the given id
+func (m *IgcFiles) FindJob(id string) (Job, error) {
+	var job Job
+	err := db.C(JOBS).FindId(bson.ObjectIdHex(id)).One(&job)
+	return job, err
+}
+
+// This function sets the given fields on a job
+func (m *IgcFiles) UpdateJob(id bson.ObjectId, set bson.M) error {
+	set["updated"] = time.Now().UTC()
+	return db.C(JOBS).UpdateId(id, bson.M{"$set": set})
+}
+
+// Stores a new job and puts it in the queue.
+// Returns errQueueFull if there is no room for it.
+func enqueueJob(ctx context.Context, kind string, url string, archive []byte, key APIKey) (Job, error) {
+	store := IGF.WithContext(ctx)
+	now := time.Now().UTC()
+	job := Job{
+		ID:        bson.NewObjectId(),
+		Kind:      kind,
+		State:     jobQueued,
+		Url:       url,
+		RequestID: requestIDFrom(ctx),
+		Created:   now,
+		Updated:   now,
+	}
+	if key.ID != "" {
+		job.OwnerKey = key.ID.Hex()
+	}
+	if err := store.InsertJob(job); err != nil {
+		return job, err
+	}
+	select {
+	case jobQueue <- jobTask{Job: job, Archive: archive, Key: key}:
+		logFrom(ctx).Info("Job queued", "job", job.ID.Hex(), "kind", kind)
+		return job, nil
+	default:
+		store.UpdateJob(job.ID, bson.M{"state": jobFailed, "error": errQueueFull.Error()})
+		return job, errQueueFull
+	}
+}
+
+// Closed by shutdown to make the workers finish the queued jobs and stop
+var stopJobs = make(chan struct{})
+
+// Counts the workers that are still running
+var jobWorkers sync.WaitGroup
+
+// Starts n workers that process the jobs in the queue
+func startJobWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		jobWorkers.Add(1)
+		go func() {
+			defer jobWorkers.Done()
+			for {
+				select {
+				case task := <-jobQueue:
+					runJob(task)
+				case <-stopJobs:
+					// Runs the jobs that are still waiting before stopping
+					for {
+						select {
+						case task := <-jobQueue:
+							runJob(task)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Processes one job the same way as it would have been processed in the request,
+// and stores the result on the job
+func runJob(task jobTask) {
+	job := task.Job
+	ctx := task.context()
+	log := logFrom(ctx).With("job", job.ID.Hex())
+	store := IGF.WithContext(ctx)
+	log.Info("Job started", "kind", job.Kind)
+	if err := store.UpdateJob(job.ID, bson.M{"state": jobRunning}); err != nil {
+		log.Error("Updating job failed", "err", err)
+	}
+
+	result := bson.M{"state": jobDone}
+	created := false
+	switch job.Kind {
+	case jobTrack:
+		content, err := fetchTrackContent(job.Url)
+		if err != nil {
+			result = bson.M{"state": jobFailed, "error": err.Error()}
+			break
+		}
+		track, duplicate, err := ingestTrack(ctx, content, job.Url, task.Key)
+		if err != nil {
+			result = bson.M{"state": jobFailed, "error": err.Error()}
+			break
+		}
+		result["track_id"] = track.ID.Hex()
+		result["duplicate"] = duplicate
+		created = !duplicate
+	case jobArchive:
+		report, err := importArchive(ctx, task.Archive, task.Key)
+		if err != nil {
+			result = bson.M{"state": jobFailed, "error": err.Error()}
+			break
+		}
+		result["report"] = report
+		created = report.Created > 0
+	default:
+		result = bson.M{"state": jobFailed, "error": fmt.Sprintf("unknown job kind %q", job.Kind)}
+	}
+
+	if err := store.UpdateJob(job.ID, result); err != nil {
+		log.Error("Updating job failed", "err", err)
+	}
+	log.Info("Job finished", "state", result["state"])
+	//Notifies all registered webhooks that changes has been made
+	if created {
+		if err := invokeWebhooks(ctx); err != nil {
+			log.Error("Invoking webhooks failed", "err", err)
+		}
+	}
+}
+
+// Tells the user where to find the job that was created
+func respondJobAccepted(w http.ResponseWriter, job Job) {
+	type returnVal struct {
+		Job    string `json:"job"`
+		Status string `json:"status_url"`
+	}
+	statusURL := "/paragliding/api/jobs/" + job.ID.Hex()
+	w.Header().Set("Location", statusURL)
+	JsonStringResponse(w, http.StatusAccepted, returnVal{job.ID.Hex(), statusURL})
+}
+
+// Returns the state of a job. Only the key that created the job and admins can see it.
+func handleGetParaglidingAPIJob(w http.ResponseWriter, r *http.Request) {
+	key, _ := requestKey(r)
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	job, err := IGF.For(r).FindJob(tmp)
+	if err == nil && key.Role != roleAdmin && job.OwnerKey != key.ID.Hex() {
+		// Answers the same as for a job that does not exist
+		err = mgo.ErrNotFound
+	}
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	JsonStringResponse(w, http.StatusOK, job)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The logger of the program. It logs text at the info level until applyConfig
+// makes it with log.format and log.level from the config.
+var logger = newLogger(os.Stdout, "text", "info")
+
+func init() {
+	// Makes the log package write through the same logger
+	slog.SetDefault(logger)
+}
+
+// Makes a logger with the given format and level.
+// An unknown level is read as info.
+func newLogger(w io.Writer, format string, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Returns the logger with the request ID of the context,
+// so every line about one request can be found
+func logFrom(ctx context.Context) *slog.Logger {
+	if ctx == nil {
+		return logger
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+// Returns a copy of the store that logs with the request ID of the context
+func (m *IgcFiles) WithContext(ctx context.Context) *IgcFiles {
+	store := *m
+	store.ctx = ctx
+	return &store
+}
+
+// Returns a copy of the store that logs with the ID of the request
+func (m *IgcFiles) For(r *http.Request) *IgcFiles {
+	return m.WithContext(r.Context())
+}
+
+func (m *IgcFiles) logger() *slog.Logger {
+	return logFrom(m.ctx)
+}
+
+// Measures a track store operation and logs it, use it as defer m.observe("name")()
+func (m *IgcFiles) observe(operation string) func() {
+	start := time.Now()
+	return func() {
+		took := time.Since(start)
+		storeDuration.WithLabelValues(operation).Observe(took.Seconds())
+		m.logger().Debug("store operation", "operation", operation, "duration_ms", took.Milliseconds())
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -17,36 +19,82 @@ var db *mgo.Database
 const (
 	COLLECTION = "tracks"
 	WEBHOOKS   = "webhooks"
+	APIKEYS    = "apikeys"
+	IGCFILES   = "igc_files"
+	JOBS       = "jobs"
+	PILOTS     = "pilots"
+	GLIDERS    = "gliders"
+	SITES      = "sites"
 )
 
-var IGF = IgcFiles{
-	Address:  os.Getenv("MONGO_ADDRESS"),
-	Database: os.Getenv("MONGO_DATABASE"),
-	Username: os.Getenv("MONGO_USER"),
-	Password: os.Getenv("MONGO_PASSWORD"),
-}
+// The database settings are set by applyConfig in config.go
+var IGF = IgcFiles{}
 
 func main() {
-	fmt.Println("Starting main")
+	printConfig := flag.Bool("print-config", false, "print the config with the secrets redacted and exit")
+	configFlags := registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+	// Reads the config file, the environment and the flags, and stops if the config is not valid
+	cfg, err := loadConfig(configFlags)
+	err = errors.Join(err, cfg.Validate())
+	if *printConfig {
+		out, _ := cfg.Redacted()
+		os.Stdout.Write(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "The config is not valid:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	applyConfig(cfg)
+
+	logger.Info("Starting main")
 
-	// Connects to the databse
-	fmt.Println("Connecting to database")
-	IGF.Connect()
-	fmt.Println("Connection success")
-	// Sends every request to the router function with Regex.
+	// Connects to the databse in the background, the API answers 503 until it is connected
+	go func() {
+		connectWithBackoff()
+		// Tracks from before the path was stored can not be found by where they were flown without it
+		IGF.backfillTrackPaths()
+		// Removes the tracks that have been in the trash longer than the retention period
+		purgeTrashLoop()
+	}()
+	// Starts the workers for background jobs and the poster of webhook notifications
+	startJobWorkers(ingestWorkers)
+	go runWebhookDispatcher()
+	// Sends every request to the router, except the metrics for Prometheus,
+	// which need an admin key, and the health checks
 	http.HandleFunc("/", handleRouter)
+	http.HandleFunc("/metrics", authorized(roleAdmin, promhttp.Handler().ServeHTTP))
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
 
-	port := os.Getenv("PORT")
-	//Listens to the Url given by heroku
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		// If the Url is wrong the program shuts down immediately.
-		fmt.Printf("Listen and serve failed %s", err)
-		log.Fatal(err)
-	}
+	//Listens to the port given by heroku
+	server := newServer(":" + config.Port)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			// If the Url is wrong the program shuts down immediately.
+			logger.Error("Listen and serve failed", "err", err)
+			os.Exit(1)
+		}
+	}()
 
+	// Runs until heroku or the orchestrator asks the program to stop
+	waitForSignal()
+	if err := shutdown(server); err != nil {
+		logger.Error("Shutdown did not finish in time", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("Shutdown complete")
 }
 
-func (m *IgcFiles) Connect() {
+// This function connects to the database and makes the indexes.
+// It returns the error instead of stopping the program, so connectWithBackoff can try again.
+func (m *IgcFiles) Connect() error {
 	session := &mgo.DialInfo{
 		Addrs:    []string{m.Address},
 		Timeout:  60 * time.Second,
@@ -57,14 +105,88 @@ func (m *IgcFiles) Connect() {
 
 	connection, err := mgo.DialWithInfo(session)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	db = connection.DB(m.Database)
+	database := connection.DB(m.Database)
+
+	// The same flight can only be stored once, tracks from before the hash
+	// was introduced have no hash and are left out of the index
+	err = database.C(COLLECTION).EnsureIndex(mgo.Index{
+		Key:    []string{"content_hash"},
+		Unique: true,
+		Sparse: true,
+	})
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	// Two pilots can not have the same name or alias
+	err = database.C(PILOTS).EnsureIndex(mgo.Index{
+		Key:    []string{"name_keys"},
+		Unique: true,
+	})
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	// Tracks are found by where they were flown with the path, see geo.go
+	err = database.C(COLLECTION).EnsureIndex(mgo.Index{
+		Key: []string{"$2dsphere:path"},
+	})
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	// Two gliders can not have the same name or alias
+	err = database.C(GLIDERS).EnsureIndex(mgo.Index{
+		Key:    []string{"name_keys"},
+		Unique: true,
+	})
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	// Sites are imported by name, so two sites can not have the same name
+	err = database.C(SITES).EnsureIndex(mgo.Index{
+		Key:    []string{"name_key"},
+		Unique: true,
+	})
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	// Finished jobs are removed by mongodb a week after they were last updated
+	err = database.C(JOBS).EnsureIndex(mgo.Index{
+		Key:         []string{"updated"},
+		ExpireAfter: 7 * 24 * time.Hour,
+	})
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	db = database
+	storeConnected.Store(true)
+	return nil
+}
+
+// Adds a condition to the query so it only matches tracks that are not in the trash
+func live(query bson.M) bson.M {
+	q := bson.M{"deleted_at": bson.M{"$exists": false}}
+	for key, val := range query {
+		q[key] = val
+	}
+	return q
 }
 
 // This function is for inserting a document into the databse
 func (m *IgcFiles) Insert(track Track) error {
-	fmt.Println("Trying to insert into the db")
+	defer m.observe("insert")()
 	// Inserts the track parameter into the right collection in the database.
 	// returns error if failed
 	err := db.C(COLLECTION).Insert(&track)
@@ -72,62 +194,100 @@ func (m *IgcFiles) Insert(track Track) error {
 }
 
 // This function returns all documents from a collection in the database
-func (m *IgcFiles) FindAll() ([]Track, error) {
-	fmt.Println("Trying to find all")
+// that match the query
+func (m *IgcFiles) FindAll(query bson.M) ([]Track, error) {
+	defer m.observe("find_all")()
 	var tracks []Track
-	// Using the nil parameter in find gets all tracks
-	err := db.C(COLLECTION).Find(nil).All(&tracks)
+	// Using an empty query in find gets all tracks
+	err := db.C(COLLECTION).Find(live(query)).All(&tracks)
 	return tracks, err
 }
 
 // This function finds one document in the collection based in the id parameter
 func (m *IgcFiles) FindOne(id string) (Track, error) {
-	fmt.Println("Trying to find one by id")
+	defer m.observe("find_one")()
 	var track Track
 	// Using bson.ObjectIdHex to convert the ID send to a hex,
 	// then compares it to the hexadesimal IDs generated by mongodb
-	err := db.C(COLLECTION).FindId(bson.ObjectIdHex(id)).One(&track)
+	err := db.C(COLLECTION).Find(live(bson.M{"_id": bson.ObjectIdHex(id)})).One(&track)
+	return track, err
+}
+
+// This function finds the track with the given content hash,
+// also if it is in the trash
+func (m *IgcFiles) FindByHash(hash string) (Track, error) {
+	defer m.observe("find_by_hash")()
+	var track Track
+	err := db.C(COLLECTION).Find(bson.M{"content_hash": hash}).One(&track)
 	return track, err
 }
 
 // This function returns the latest inserted document in the database
 func (m *IgcFiles) FindLatest() (Track, error) {
+	defer m.observe("find_latest")()
 	var track Track
 	// Returns the first object of all documents sorted by "_id"
-	err := db.C(COLLECTION).Find(nil).Sort("-_id").One(&track)
+	err := db.C(COLLECTION).Find(live(nil)).Sort("-_id").One(&track)
 	return track, err
 }
 
 // This function returns an int with the count of how many documents
 // are in a collection in the database
 func (m *IgcFiles) FindCount() (int, error) {
-	trackCount, err := db.C(COLLECTION).Count()
+	defer m.observe("count")()
+	trackCount, err := db.C(COLLECTION).Find(live(nil)).Count()
 	return trackCount, err
 }
 
-// This function deletes all documents in a collection
+// This function sets the given fields on the document with the given id
+// and returns the updated document
+func (m *IgcFiles) UpdateOne(id string, set bson.M) (Track, error) {
+	defer m.observe("update_one")()
+	var track Track
+	change := mgo.Change{
+		Update:    bson.M{"$set": set},
+		ReturnNew: true,
+	}
+	_, err := db.C(COLLECTION).Find(live(bson.M{"_id": bson.ObjectIdHex(id)})).Apply(change, &track)
+	return track, err
+}
+
+// This function moves the document with the given id to the trash
+// by setting deleted_at. It is removed for good by PurgeTrash.
+func (m *IgcFiles) DeleteOne(id string) error {
+	defer m.observe("delete_one")()
+	return db.C(COLLECTION).Update(
+		live(bson.M{"_id": bson.ObjectIdHex(id)}),
+		bson.M{"$set": bson.M{"deleted_at": time.Now().UTC()}},
+	)
+}
+
+// This function moves all documents in a collection to the trash
 func (m *IgcFiles) DeleteAll() (*mgo.ChangeInfo, error) {
-	rem, err := db.C(COLLECTION).RemoveAll(nil)
+	defer m.observe("delete_all")()
+	rem, err := db.C(COLLECTION).UpdateAll(live(nil), bson.M{"$set": bson.M{"deleted_at": time.Now().UTC()}})
 	return rem, err
 }
 
 func (m *IgcFiles) FindOldest() ([]Track, error) {
+	defer m.observe("find_oldest")()
 	var tracks []Track
 	// Gets the first 5 object when documents are sorted reverse order by giving "-" to _id
-	err := db.C(COLLECTION).Find(nil).Sort("timestamp").Limit(5).All(&tracks)
+	err := db.C(COLLECTION).Find(live(nil)).Sort("timestamp").Limit(5).All(&tracks)
 	return tracks, err
 }
 
 func (m *IgcFiles) FindOldestById(id int) ([]Track, error) {
+	defer m.observe("find_oldest_by_id")()
 	var tracks []Track
 	var startPoint Track
 	err := db.C(COLLECTION).Find(bson.M{"timestamp": id}).One(&startPoint)
-	err = db.C(COLLECTION).Find(bson.M{"timestamp": bson.M{"$gt": startPoint.Timestamp}}).Limit(5).All(&tracks)
+	err = db.C(COLLECTION).Find(live(bson.M{"timestamp": bson.M{"$gt": startPoint.Timestamp}})).Limit(5).All(&tracks)
 	return tracks, err
 }
 
 func (m *IgcFiles) NewWebHook(webhook Webhooks) error {
-	fmt.Println("Trying to insert new webhook into the db")
+	m.logger().Debug("Trying to insert new webhook into the db")
 	// Inserts the webhook into the right collection in the database.
 	// returns error if failed
 	err := db.C(WEBHOOKS).Insert(&webhook)
@@ -135,7 +295,7 @@ func (m *IgcFiles) NewWebHook(webhook Webhooks) error {
 }
 
 func (m *IgcFiles) getAllWebhooks() ([]Webhooks, error) {
-	fmt.Println("Trying to find all")
+	m.logger().Debug("Trying to find all webhooks")
 	var webhook []Webhooks
 	// Using the nil parameter in find gets all tracks
 	err := db.C(WEBHOOKS).Find(nil).All(&webhook)
@@ -144,18 +304,19 @@ func (m *IgcFiles) getAllWebhooks() ([]Webhooks, error) {
 
 // Returns the oldest webhook in the collection
 func (m *IgcFiles) FindOldestByIdWebhook(id int) ([]Track, error) {
+	defer m.observe("find_newer_than")()
 	var tracks []Track
 	var startPoint Track
 	// Using bson to match the id
 	err := db.C(COLLECTION).Find(bson.M{"timestamp": id}).One(&startPoint)
 	// using bson with the parameter $gt to get all with timestamp greater than given
-	err = db.C(COLLECTION).Find(bson.M{"timestamp": bson.M{"$gt": startPoint.Timestamp}}).All(&tracks)
+	err = db.C(COLLECTION).Find(live(bson.M{"timestamp": bson.M{"$gt": startPoint.Timestamp}})).All(&tracks)
 	return tracks, err
 }
 
 // This function finds one document in the collection based in the id parameter
 func (m *IgcFiles) FindOneWebhook(id string) (Webhooks, error) {
-	fmt.Println("Trying to find one webhook by id")
+	m.logger().Debug("Trying to find one webhook by id")
 	var webhook Webhooks
 	// Using bson.ObjectIdHex to convert the ID send to a hex,
 	// then compares it to the hexadesimal IDs generated by mongodb
@@ -165,7 +326,7 @@ func (m *IgcFiles) FindOneWebhook(id string) (Webhooks, error) {
 
 //returns the values from one webhook of given ID, then deletes it
 func (m *IgcFiles) DeleteOneHook(id string) (Webhooks, error) {
-	fmt.Println("Trying to delete one webhook by id")
+	m.logger().Debug("Trying to delete one webhook by id")
 	var webhook Webhooks
 	// Using bson.ObjectIdHex to convert the ID send to a hex,
 	// then compares it to the hexadesimal IDs generated by mongodb
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics served at /metrics for Prometheus.
+// They all start with paragliding_ so they are easy to find in Grafana.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "paragliding_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "paragliding_http_request_duration_seconds",
+		Help:    "Time spent answering HTTP requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	ingestTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "paragliding_ingest_total",
+		Help: "Track ingestions by outcome: created, duplicate or failed.",
+	}, []string{"outcome"})
+
+	ingestFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "paragliding_ingest_failures_total",
+		Help: "Failed track ingestions and downloads by error code.",
+	}, []string{"reason"})
+
+	igcParseDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "paragliding_igc_parse_duration_seconds",
+		Help:    "Time spent parsing igc files.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "paragliding_store_operation_duration_seconds",
+		Help:    "Time spent on track store operations in the database.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"operation"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "paragliding_webhook_deliveries_total",
+		Help: "Webhook notifications by outcome: delivered, rejected, failed or dropped.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "paragliding_uptime_seconds",
+		Help: "Seconds since the service started, the same uptime as in GET /paragliding/api.",
+	}, func() float64 { return time.Since(startTime).Seconds() })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "paragliding_queue_depth",
+		Help:        "Items waiting in a queue.",
+		ConstLabels: prometheus.Labels{"queue": "webhooks"},
+	}, func() float64 { return float64(len(webhookQueue)) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "paragliding_queue_depth",
+		Help:        "Items waiting in a queue.",
+		ConstLabels: prometheus.Labels{"queue": "jobs"},
+	}, func() float64 { return float64(len(jobQueue)) })
+}
+
+// Remembers the status code the handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Counts the request, measures how long it took and writes the access log.
+// The route is the path from the routes table, like /paragliding/api/track/{id},
+// so tracks with different IDs are counted together.
+func observeRequest(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	start := time.Now()
+	route := routeLabel(r)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next(rec, r)
+	took := time.Since(start)
+	httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	httpDuration.WithLabelValues(route, r.Method).Observe(took.Seconds())
+	logFrom(r.Context()).Info("Request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", route,
+		"status", rec.status,
+		"duration_ms", took.Milliseconds(),
+	)
+}
+
+// Returns the route of the routes table the request goes to,
+// or "unmatched" for paths that are not in it
+func routeLabel(r *http.Request) string {
+	_, pattern := router.Handler(r)
+	// No method matched, then the path can still be known
+	if pattern == "/" {
+		_, pattern = routerPaths.Handler(r)
+	}
+	if pattern == "" || pattern == "/" {
+		return "unmatched"
+	}
+	// Removes the method in front and the trailing slash pattern at the end
+	if i := strings.Index(pattern, " "); i >= 0 {
+		pattern = pattern[i+1:]
+	}
+	return strings.TrimSuffix(pattern, "/{$}")
+}
+
+// Counts a failed ingestion by the code of its error
+func countIngestFailure(err error) {
+	reason := "internal_error"
+	var fe *fetchError
+	var ae *apiError
+	if errors.As(err, &fe) {
+		reason = fe.Code
+	} else if errors.As(err, &ae) {
+		reason = ae.Code
+	}
+	ingestFailures.WithLabelValues(reason).Inc()
+	ingestTotal.WithLabelValues("failed").Inc()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A collection of things that tracks are linked to by a name in the igc header,
+// like the pilots and the gliders. They are found by the keys of their name and aliases,
+// which are stored in name_keys with a unique index, see nameKey.
+type nameRegistry struct {
+	Collection string
+	// The field of the track with the name from the igc header
+	TrackField string
+	// The field of the track with the id of the thing it is linked to
+	RefField string
+	// The code of the 409 answer when another one already has the name, and what it is called in the message
+	TakenCode string
+	Noun      string
+}
+
+var pilotRegistry = nameRegistry{PILOTS, "pilot", "pilot_id", "pilot_name_taken", "pilot"}
+var gliderRegistry = nameRegistry{GLIDERS, "glider", "glider_ref", "glider_name_taken", "glider"}
+
+// Finds the one with the given name or alias and puts it in result
+func (m *IgcFiles) findByName(reg nameRegistry, name string, result interface{}) error {
+	key := nameKey(name)
+	if key == "" {
+		return mgo.ErrNotFound
+	}
+	return db.C(reg.Collection).Find(bson.M{"name_keys": key}).One(result)
+}
+
+// Sets the given fields on the one with the given id and puts the updated one in result
+func (m *IgcFiles) updateByID(reg nameRegistry, id string, set bson.M, result interface{}) error {
+	change := mgo.Change{
+		Update:    bson.M{"$set": set},
+		ReturnNew: true,
+	}
+	_, err := db.C(reg.Collection).FindId(bson.ObjectIdHex(id)).Apply(change, result)
+	return err
+}
+
+// Links the tracks with one of the name keys to the given id,
+// and unlinks the tracks that no longer have one of them.
+// It is run when a pilot or glider is created or its names are changed.
+func (m *IgcFiles) linkNamedTracks(reg nameRegistry, id bson.ObjectId, nameKeys []string) error {
+	keys := map[string]bool{}
+	for _, key := range nameKeys {
+		keys[key] = true
+	}
+	var tracks []bson.M
+	err := db.C(COLLECTION).Find(bson.M{"$or": []bson.M{
+		{reg.RefField: id.Hex()},
+		{reg.RefField: bson.M{"$in": []interface{}{nil, ""}}},
+	}}).Select(bson.M{reg.TrackField: 1, reg.RefField: 1}).All(&tracks)
+	if err != nil {
+		return err
+	}
+
+	var link, unlink []interface{}
+	for _, track := range tracks {
+		name, _ := track[reg.TrackField].(string)
+		ref, _ := track[reg.RefField].(string)
+		match := keys[nameKey(name)]
+		if match && ref == "" {
+			link = append(link, track["_id"])
+		} else if !match && ref == id.Hex() {
+			unlink = append(unlink, track["_id"])
+		}
+	}
+	if len(link) > 0 {
+		_, err = db.C(COLLECTION).UpdateAll(bson.M{"_id": bson.M{"$in": link}}, bson.M{"$set": bson.M{reg.RefField: id.Hex()}})
+		if err != nil {
+			return err
+		}
+	}
+	if len(unlink) > 0 {
+		_, err = db.C(COLLECTION).UpdateAll(bson.M{"_id": bson.M{"$in": unlink}}, bson.M{"$unset": bson.M{reg.RefField: ""}})
+	}
+	return err
+}
+
+// Decodes the fields of a pilot or glider from the body into params.
+// Fields that are not in params are an error.
+func decodeNamedParams(r *http.Request, params interface{}) error {
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(params)
+}
+
+// Answers 409 when another one already has one of the names
+func nameTaken(w http.ResponseWriter, r *http.Request, reg nameRegistry) {
+	message := "another " + reg.Noun + " already has this name or alias"
+	handleError(w, r, &apiError{http.StatusConflict, reg.TakenCode, message, nil}, http.StatusConflict)
+}
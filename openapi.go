@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI document describing every route in the routes table
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// Serves the OpenAPI document
+func handleParaglidingAPIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
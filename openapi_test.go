@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// The keys of a path item in the OpenAPI document that are methods
+var openAPIMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true, "trace": true,
+}
+
+// Compares the OpenAPI document with the routes table,
+// and fails for every method and path that is only in one of them
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid json: %v", err)
+	}
+
+	documented := map[string]bool{}
+	for p, item := range doc.Paths {
+		for method := range item {
+			if openAPIMethods[method] {
+				documented[strings.ToUpper(method)+" "+p] = true
+			}
+		}
+	}
+	routed := map[string]bool{}
+	for _, rt := range routes {
+		routed[rt.Method+" "+rt.Path] = true
+	}
+
+	for op := range routed {
+		if !documented[op] {
+			t.Errorf("%s is routed but not in openapi.json", op)
+		}
+	}
+	for op := range documented {
+		if !routed[op] {
+			t.Errorf("%s is in openapi.json but not routed", op)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+// The speed and glide ratio of a track, calculated from its fixes when it is ingested
+type TrackPerformance struct {
+	// Kilometres flown for every kilometre of height lost while gliding,
+	// 0 if the track has no glides
+	GlideRatio float64 `bson:"glide_ratio" json:"glide_ratio"`
+	// The highest ground speed in km/h over speedWindow
+	MaxSpeed float64 `bson:"max_speed" json:"max_speed"`
+}
+
+const (
+	// Speeds are measured over this time, so a single bad fix does not make a record
+	speedWindow = 10 * time.Second
+	// The flight is cut in pieces this long to find the glides
+	glideWindow = 20 * time.Second
+	// A piece is a glide if it loses height, moves at least this fast (km/h)
+	glideMinSpeed = 15.0
+	// and goes mostly straight, so thermalling is left out
+	glideMinStraightness = 0.7
+)
+
+// Returns the altitude of the fix in metres. The pressure altitude is used
+// when the recorder has it, it is smoother than the GPS altitude.
+func fixAltitude(p igc.Point) float64 {
+	if p.PressureAltitude != 0 {
+		return float64(p.PressureAltitude)
+	}
+	return float64(p.GNSSAltitude)
+}
+
+// Returns the time from a to b, also when the flight goes over midnight UTC
+func fixInterval(a igc.Point, b igc.Point) time.Duration {
+	d := b.Time.Sub(a.Time)
+	if d < 0 {
+		d += 24 * time.Hour
+	}
+	return d
+}
+
+// Calculates the max speed and the glide ratio of the track
+func getTrackPerformance(s igc.Track) TrackPerformance {
+	var perf TrackPerformance
+	points := s.Points
+	if len(points) < 2 {
+		return perf
+	}
+
+	// The max speed is the straight distance between two fixes at least speedWindow apart
+	j := 0
+	for i := range points {
+		if j < i {
+			j = i
+		}
+		for j < len(points)-1 && fixInterval(points[i], points[j]) < speedWindow {
+			j++
+		}
+		dt := fixInterval(points[i], points[j])
+		if dt < speedWindow {
+			break
+		}
+		speed := points[i].Distance(points[j]) / dt.Hours()
+		if speed > perf.MaxSpeed {
+			perf.MaxSpeed = speed
+		}
+	}
+
+	// The glide ratio is the distance flown in the glides divided by the height lost in them
+	var glideDistance, glideLoss float64
+	start := 0
+	path := 0.0
+	for i := 1; i < len(points); i++ {
+		path += points[i-1].Distance(points[i])
+		dt := fixInterval(points[start], points[i])
+		if dt < glideWindow {
+			continue
+		}
+		loss := (fixAltitude(points[start]) - fixAltitude(points[i])) / 1000
+		straight := points[start].Distance(points[i])
+		if loss > 0 && path/dt.Hours() >= glideMinSpeed && path > 0 && straight/path >= glideMinStraightness {
+			glideDistance += path
+			glideLoss += loss
+		}
+		start = i
+		path = 0
+	}
+	if glideLoss > 0 {
+		perf.GlideRatio = glideDistance / glideLoss
+	}
+	return perf
+}
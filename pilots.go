@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	igc "github.com/marni/goigc"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The number of flights in best_flights
+const bestFlightsCount = 5
+
+// Returns the pilot id the track should be linked to, or "" if no pilot has its name
+func (m *IgcFiles) pilotIDForName(name string) string {
+	var pilot Pilot
+	if err := m.findByName(pilotRegistry, name, &pilot); err != nil {
+		return ""
+	}
+	return pilot.ID.Hex()
+}
+
+// This function inserts a new pilot into the database
+func (m *IgcFiles) InsertPilot(pilot Pilot) error {
+	return db.C(PILOTS).Insert(&pilot)
+}
+
+// This function returns all pilots sorted by name
+func (m *IgcFiles) FindAllPilots() ([]Pilot, error) {
+	var pilots []Pilot
+	err := db.C(PILOTS).Find(nil).Sort("name").All(&pilots)
+	return pilots, err
+}
+
+// This function finds the pilot with the given id
+func (m *IgcFiles) FindPilot(id string) (Pilot, error) {
+	var pilot Pilot
+	err := db.C(PILOTS).FindId(bson.ObjectIdHex(id)).One(&pilot)
+	return pilot, err
+}
+
+// The statistics of one pilot
+type PilotStats struct {
+	Flights int `json:"total_flights"`
+	// Hours in the air, from the first to the last fix of every flight
+	Hours float64 `json:"hours"`
+	// Kilometres along the tracks
+	Distance    float64       `json:"distance"`
+	BestFlights []PilotFlight `json:"best_flights"`
+	// The sites the pilot took off from the most, see sites.go
+	FavouriteSites []PilotSite `json:"favourite_sites"`
+}
+
+// A flight in the statistics
+type PilotFlight struct {
+	ID       string    `json:"id"`
+	Date     time.Time `json:"date"`
+	Distance float64   `json:"distance"`
+	Duration int64     `json:"duration"`
+}
+
+// Calculates the statistics of the pilot from its tracks.
+// Tracks stored before the duration was calculated get it from their igc file, see backfillTrack.
+func (m *IgcFiles) PilotStats(id string) (PilotStats, error) {
+	stats := PilotStats{BestFlights: []PilotFlight{}}
+	tracks, err := m.FindAll(bson.M{"pilot_id": id})
+	if err != nil {
+		return stats, err
+	}
+	for _, track := range tracks {
+		if track.Duration == 0 {
+			m.backfillTrack(&track)
+		}
+		stats.Flights++
+		stats.Hours += float64(track.Duration) / 3600
+		stats.Distance += track.TrackLenght
+		stats.BestFlights = append(stats.BestFlights, PilotFlight{track.ID.Hex(), track.HDate, track.TrackLenght, track.Duration})
+	}
+	// The longest flights are the best
+	sort.Slice(stats.BestFlights, func(i, j int) bool {
+		return stats.BestFlights[i].Distance > stats.BestFlights[j].Distance
+	})
+	if len(stats.BestFlights) > bestFlightsCount {
+		stats.BestFlights = stats.BestFlights[:bestFlightsCount]
+	}
+	stats.FavouriteSites, err = m.favouriteSites(tracks)
+	return stats, err
+}
+
+// Calculates the duration, performance, first and last fix, sites and path of a track stored
+// before they were calculated at ingestion, and saves them so it is only done once.
+// The track is left as it is if its igc file is missing.
+func (m *IgcFiles) backfillTrack(track *Track) {
+	content, err := m.FindContent(track.ID)
+	if err != nil {
+		return
+	}
+	parsed, err := igc.Parse(string(content))
+	if err != nil {
+		return
+	}
+	performance := getTrackPerformance(parsed)
+	track.Duration = getTrackDuration(parsed)
+	track.Performance = &performance
+	track.Takeoff, track.Landing = getTrackEnds(parsed)
+	m.tagTrackSites(track)
+	track.Path = getTrackPath(parsed)
+	set := bson.M{
+		"duration":     track.Duration,
+		"performance":  track.Performance,
+		"takeoff":      track.Takeoff,
+		"landing":      track.Landing,
+		"takeoff_site": track.TakeoffSite,
+		"landing_site": track.LandingSite,
+		"path":         track.Path,
+	}
+	if err := db.C(COLLECTION).UpdateId(track.ID, bson.M{"$set": set}); err != nil {
+		m.logger().Warn("Storing the calculated values failed", "track", track.ID.Hex(), "err", err)
+	}
+}
+
+// The fields of a pilot that can be sent when it is created or changed
+type pilotParams struct {
+	Name        *string   `json:"name"`
+	Aliases     *[]string `json:"aliases"`
+	Nationality *string   `json:"nationality"`
+	LicenceID   *string   `json:"licence_id"`
+}
+
+// Removes empty aliases and spaces around them
+func cleanAliases(aliases []string) []string {
+	cleaned := []string{}
+	for _, alias := range aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			cleaned = append(cleaned, alias)
+		}
+	}
+	return cleaned
+}
+
+// Returns all pilots
+func handleGetParaglidingAPIPilots(w http.ResponseWriter, r *http.Request) {
+	pilots, err := IGF.For(r).FindAllPilots()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if pilots == nil {
+		pilots = []Pilot{}
+	}
+	JsonStringResponse(w, http.StatusOK, pilots)
+}
+
+// Creates a pilot and links the tracks with its name or aliases to it
+func handlePostParaglidingAPIPilots(w http.ResponseWriter, r *http.Request) {
+	var params pilotParams
+	if err := decodeNamedParams(r, &params); err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if params.Name == nil || nameKey(*params.Name) == "" {
+		handleError(w, r, fmt.Errorf("name is required"), http.StatusBadRequest)
+		return
+	}
+
+	pilot := Pilot{
+		ID:      bson.NewObjectId(),
+		Name:    strings.TrimSpace(*params.Name),
+		Aliases: []string{},
+		Created: time.Now().UTC(),
+	}
+	if params.Aliases != nil {
+		pilot.Aliases = cleanAliases(*params.Aliases)
+	}
+	if params.Nationality != nil {
+		pilot.Nationality = strings.ToUpper(strings.TrimSpace(*params.Nationality))
+	}
+	if params.LicenceID != nil {
+		pilot.LicenceID = strings.TrimSpace(*params.LicenceID)
+	}
+	pilot.NameKeys = nameKeys(pilot.Name, pilot.Aliases)
+
+	store := IGF.For(r)
+	if err := store.InsertPilot(pilot); err != nil {
+		if mgo.IsDup(err) {
+			nameTaken(w, r, pilotRegistry)
+			return
+		}
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := store.linkNamedTracks(pilotRegistry, pilot.ID, pilot.NameKeys); err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/paragliding/api/pilots/"+pilot.ID.Hex())
+	JsonStringResponse(w, http.StatusCreated, pilot)
+}
+
+// Returns the pilot with the given ID and its statistics
+func handleGetParaglidingAPIPilotID(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	store := IGF.For(r)
+	pilot, err := store.FindPilot(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	stats, err := store.PilotStats(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	type returnVal struct {
+		Pilot
+		PilotStats
+	}
+	JsonStringResponse(w, http.StatusOK, returnVal{pilot, stats})
+}
+
+// Changes the pilot with the given ID. Only the fields in the body are changed.
+// If the name or aliases change the tracks are linked again.
+func handlePatchParaglidingAPIPilotID(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	var params pilotParams
+	if err := decodeNamedParams(r, &params); err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	store := IGF.For(r)
+	pilot, err := store.FindPilot(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	set := bson.M{}
+	if params.Name != nil {
+		if nameKey(*params.Name) == "" {
+			handleError(w, r, fmt.Errorf("name can not be empty"), http.StatusBadRequest)
+			return
+		}
+		pilot.Name = strings.TrimSpace(*params.Name)
+		set["name"] = pilot.Name
+	}
+	if params.Aliases != nil {
+		pilot.Aliases = cleanAliases(*params.Aliases)
+		set["aliases"] = pilot.Aliases
+	}
+	if params.Nationality != nil {
+		set["nationality"] = strings.ToUpper(strings.TrimSpace(*params.Nationality))
+	}
+	if params.LicenceID != nil {
+		set["licence_id"] = strings.TrimSpace(*params.LicenceID)
+	}
+	if len(set) == 0 {
+		handleError(w, r, fmt.Errorf("nothing to update"), http.StatusBadRequest)
+		return
+	}
+	set["name_keys"] = nameKeys(pilot.Name, pilot.Aliases)
+
+	if err := store.updateByID(pilotRegistry, tmp, set, &pilot); err != nil {
+		if mgo.IsDup(err) {
+			nameTaken(w, r, pilotRegistry)
+			return
+		}
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if params.Name != nil || params.Aliases != nil {
+		if err := store.linkNamedTracks(pilotRegistry, pilot.ID, pilot.NameKeys); err != nil {
+			handleError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	JsonStringResponse(w, http.StatusOK, pilot)
+}
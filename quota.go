@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The number of tracks a key can upload each day if the key has no quota of its own.
+// 0 means there is no limit.
+var defaultDailyQuota int
+
+// The daily_quota of a key that has no limit, also when UPLOAD_DAILY_QUOTA is set.
+// 0 can not be used for this, since keys without a quota of their own have 0.
+const unlimitedQuota = -1
+
+// Returns the number of tracks uploaded with the given key since the timestamp
+func (m *IgcFiles) CountUploadsSince(ownerKey string, since int64) (int, error) {
+	return db.C(COLLECTION).Find(bson.M{
+		"owner_key": ownerKey,
+		"timestamp": bson.M{"$gte": since},
+	}).Count()
+}
+
+// Returns the number of track uploads with the given key that are queued or running as jobs.
+// They count against the quota, or ?async=true could be used to upload past it.
+func (m *IgcFiles) CountPendingUploads(ownerKey string) (int, error) {
+	return db.C(JOBS).Find(bson.M{
+		"owner_key": ownerKey,
+		"kind":      jobTrack,
+		"state":     bson.M{"$in": []string{jobQueued, jobRunning}},
+	}).Count()
+}
+
+// Checks if the key has used up its quota of uploads for today (UTC).
+// Admins, and the bootstrap key which has no ID, do not have a quota.
+// The uploads are counted before the track is stored, so uploads sent at the same
+// time with the last of the quota can all get through. The quota is a soft limit,
+// the rate limits are what protect the service.
+func checkUploadQuota(w http.ResponseWriter, r *http.Request, key APIKey) bool {
+	quota := key.DailyQuota
+	if quota == 0 {
+		quota = defaultDailyQuota
+	}
+	if quota <= 0 || key.Role == roleAdmin || key.ID == "" {
+		return true
+	}
+
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	store := IGF.For(r)
+	uploads, err := store.CountUploadsSince(key.ID.Hex(), midnight.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return false
+	}
+	pending, err := store.CountPendingUploads(key.ID.Hex())
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return false
+	}
+	uploads += pending
+	if uploads >= quota {
+		// The quota resets at the next midnight
+		retry := midnight.Add(24 * time.Hour).Sub(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+		msg := fmt.Sprintf("daily upload quota of %d tracks used", quota)
+		handleError(w, r, &apiError{http.StatusTooManyRequests, "quota_exceeded", msg, nil}, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The groups of routes that have their own rate limit
+const (
+	limitRead    = "read"
+	limitUpload  = "upload"
+	limitWebhook = "webhook"
+	limitAdmin   = "admin"
+	// Failed authentications, counted by IP before the key is looked up
+	limitAuth = "auth"
+)
+
+// The rate limiter of every group, made by applyConfig.
+// A group without a limiter is not limited.
+var rateLimiters = map[string]*rateLimiter{}
+
+// When true the client IP is taken from X-Forwarded-For, only use it behind a proxy like heroku's router
+var rateLimitTrustProxy bool
+
+var rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "paragliding_rate_limited_total",
+	Help: "Requests answered with 429 by the rate limiter, by route group.",
+}, []string{"group"})
+
+// The tokens left for one client. A request takes one token,
+// and the tokens come back at the rate of the limiter up to the burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets for all the clients of one route group
+type rateLimiter struct {
+	// Tokens per second
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Makes a limiter that allows rate requests per second, and burst requests at once.
+// Returns nil if rate is 0, which means no limit.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+// Takes a token for the client if there is one.
+// If there is not, it returns how long until there is.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Returns how long until the client has a token, without taking it
+func (l *rateLimiter) wait(client string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		return 0
+	}
+	tokens := math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / l.rate * float64(time.Second))
+}
+
+// Forgets the clients whose bucket is full again, they are the same as new clients.
+// Runs at most once a minute so the map does not grow forever.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Returns who the request is counted for: the API key if it has one, otherwise the IP
+func rateLimitClient(r *http.Request) string {
+	if key, ok := requestKey(r); ok {
+		if key.ID == "" {
+			return "key:" + key.Name
+		}
+		return "key:" + key.ID.Hex()
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Returns the IP of the client
+func clientIP(r *http.Request) string {
+	if rateLimitTrustProxy {
+		// The proxy adds the address it got the request from at the end
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Answers 429 with Retry-After when the client has used up the requests of the group.
+// It runs after authorize, so clients with a key are limited by their key.
+// Failed authentications are limited by IP in authorize, see authAttemptAllowed.
+func rateLimited(group string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := rateLimiters[group]
+		if limiter == nil {
+			handler(w, r)
+			return
+		}
+		ok, wait := limiter.allow(rateLimitClient(r), time.Now())
+		if !ok {
+			writeRateLimited(w, r, group, wait)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Answers 429 with the seconds until the client has a token again
+func writeRateLimited(w http.ResponseWriter, r *http.Request, group string, wait time.Duration) {
+	rateLimitedRequests.WithLabelValues(group).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	handleError(w, r, &apiError{http.StatusTooManyRequests, "rate_limited", "too many requests, try again later", nil}, http.StatusTooManyRequests)
+}
+
+// Answers 429 and returns false when the IP of the request has failed to authenticate too often.
+// It runs before the key is looked up, so guessing keys does not cost a database query each time.
+func authAttemptAllowed(w http.ResponseWriter, r *http.Request) bool {
+	limiter := rateLimiters[limitAuth]
+	if limiter == nil {
+		return true
+	}
+	if wait := limiter.wait("ip:"+clientIP(r), time.Now()); wait > 0 {
+		writeRateLimited(w, r, limitAuth, wait)
+		return false
+	}
+	return true
+}
+
+// Takes a token from the IP of a request that was answered 401 or sent an unknown key
+func authFailed(r *http.Request) {
+	if limiter := rateLimiters[limitAuth]; limiter != nil {
+		limiter.allow("ip:"+clientIP(r), time.Now())
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A route of the API. Path uses the net/http pattern syntax, which is written
+// the same way as the paths in the OpenAPI document, like /paragliding/api/track/{id}.
+// The handler can get the values in {} with r.PathValue.
+type route struct {
+	Method string
+	Path   string
+	// The role the API key needs, see authorize in auth.go
+	Role string
+	// The rate limit the route counts against, see ratelimit.go
+	Group   string
+	Handler http.HandlerFunc
+}
+
+// All the routes of the API.
+// openapi.json describes the same routes, and TestOpenAPIMatchesRoutes fails if they disagree.
+var routes = []route{
+	{http.MethodGet, "/paragliding", roleNone, limitRead, handleParaglidingRedirect},
+	{http.MethodGet, "/paragliding/api", roleNone, limitRead, handleParaglidingAPI},
+	{http.MethodGet, "/paragliding/api/openapi.json", roleNone, limitRead, handleParaglidingAPIOpenAPI},
+
+	{http.MethodGet, "/paragliding/api/track", roleReader, limitRead, handleGetParaglidingAPITrack},
+	{http.MethodPost, "/paragliding/api/track", roleUploader, limitUpload, handlePostParaglidingAPITrack},
+	{http.MethodGet, "/paragliding/api/track/{id}", roleReader, limitRead, handleGetParaglidingAPITrackID},
+	{http.MethodPatch, "/paragliding/api/track/{id}", roleUploader, limitUpload, handlePatchParaglidingAPITrackID},
+	{http.MethodDelete, "/paragliding/api/track/{id}", roleUploader, limitUpload, handleDeleteParaglidingAPITrackID},
+	{http.MethodGet, "/paragliding/api/track/{id}/{field}", roleReader, limitRead, handleParaglidingAPITrackIDField},
+
+	{http.MethodGet, "/paragliding/api/ticker/latest", roleReader, limitRead, handleParaglidingAPITickerLatest},
+	{http.MethodGet, "/paragliding/api/ticker", roleReader, limitRead, handleParaglidingAPITicker},
+	{http.MethodGet, "/paragliding/api/ticker/{timestamp}", roleReader, limitRead, handleParaglidingAPITickerTimestamp},
+
+	{http.MethodPost, "/paragliding/api/webhook/new_track", roleUploader, limitWebhook, handlePOSTParaglidingAPIWebhookNew},
+	{http.MethodGet, "/paragliding/api/webhook/new_track/{id}", roleReader, limitWebhook, handleGetWebhook},
+	{http.MethodDelete, "/paragliding/api/webhook/new_track/{id}", roleUploader, limitWebhook, handleDeleteWebhook},
+
+	{http.MethodGet, "/paragliding/api/pilots", roleReader, limitRead, handleGetParaglidingAPIPilots},
+	{http.MethodPost, "/paragliding/api/pilots", roleAdmin, limitUpload, handlePostParaglidingAPIPilots},
+	{http.MethodGet, "/paragliding/api/pilots/{id}", roleReader, limitRead, handleGetParaglidingAPIPilotID},
+	{http.MethodPatch, "/paragliding/api/pilots/{id}", roleAdmin, limitUpload, handlePatchParaglidingAPIPilotID},
+	{http.MethodGet, "/paragliding/api/gliders", roleReader, limitRead, handleGetParaglidingAPIGliders},
+	{http.MethodPost, "/paragliding/api/gliders", roleAdmin, limitUpload, handlePostParaglidingAPIGliders},
+	{http.MethodGet, "/paragliding/api/gliders/{id}", roleReader, limitRead, handleGetParaglidingAPIGliderID},
+	{http.MethodPatch, "/paragliding/api/gliders/{id}", roleAdmin, limitUpload, handlePatchParaglidingAPIGliderID},
+	{http.MethodGet, "/paragliding/api/sites", roleReader, limitRead, handleGetParaglidingAPISites},
+	{http.MethodGet, "/paragliding/api/sites/{id}", roleReader, limitRead, handleGetParaglidingAPISiteID},
+	{http.MethodGet, "/paragliding/api/sites/{id}/tracks", roleReader, limitRead, handleGetParaglidingAPISiteIDTracks},
+
+	{http.MethodGet, "/paragliding/api/jobs/{id}", roleUploader, limitRead, handleGetParaglidingAPIJob},
+
+	{http.MethodGet, "/admin/api/tracks_count", roleAdmin, limitAdmin, handleGetAdminApiTracksCount},
+	{http.MethodDelete, "/admin/api/tracks", roleAdmin, limitAdmin, handleDeleteAdminApiTracks},
+	{http.MethodGet, "/admin/api/trash", roleAdmin, limitAdmin, handleGetAdminApiTrash},
+	{http.MethodPost, "/admin/api/trash/{id}/restore", roleAdmin, limitAdmin, handlePostAdminApiTrashRestore},
+	{http.MethodGet, "/admin/api/export", roleAdmin, limitAdmin, handleGetAdminApiExport},
+	{http.MethodPost, "/admin/api/import", roleAdmin, limitAdmin, handlePostAdminApiImport},
+	{http.MethodPost, "/admin/api/import/igc", roleAdmin, limitAdmin, handlePostAdminApiImportIgc},
+	{http.MethodPost, "/admin/api/sites/import", roleAdmin, limitAdmin, handlePostAdminApiSitesImport},
+	{http.MethodGet, "/admin/api/sites/suggestions", roleAdmin, limitAdmin, handleGetAdminApiSiteSuggestions},
+	{http.MethodPost, "/admin/api/sites/suggestions/{id}/accept", roleAdmin, limitAdmin, handlePostAdminApiSiteSuggestionAccept},
+	{http.MethodGet, "/admin/api/keys", roleAdmin, limitAdmin, handleGetAdminApiKeys},
+	{http.MethodPost, "/admin/api/keys", roleAdmin, limitAdmin, handlePostAdminApiKeys},
+	{http.MethodDelete, "/admin/api/keys/{id}", roleAdmin, limitAdmin, handleDeleteAdminApiKey},
+}
+
+// The router is made once when the program starts.
+// routerPaths is the part of it that answers the requests no route matches.
+var router, routerPaths = newRouter(routes)
+
+// Makes a ServeMux from the routes table.
+// Every path is also registered with a trailing slash. Requests that match no
+// route go to a second ServeMux, made only of the paths, which answers OPTIONS
+// and gives 405 with an Allow header when the path is known, and 404 when it is not.
+func newRouter(table []route) (*http.ServeMux, *http.ServeMux) {
+	mux := http.NewServeMux()
+	paths := http.NewServeMux()
+	allowed := map[string][]string{}
+	for _, rt := range table {
+		handler := withStore(authorized(rt.Role, rateLimited(rt.Group, rt.Handler)))
+		mux.HandleFunc(rt.Method+" "+rt.Path, handler)
+		mux.HandleFunc(rt.Method+" "+rt.Path+"/{$}", handler)
+		allowed[rt.Path] = append(allowed[rt.Path], rt.Method)
+	}
+	for p, methods := range allowed {
+		handler := methodNotAllowed(allowHeader(methods))
+		paths.HandleFunc(p, handler)
+		paths.HandleFunc(p+"/{$}", handler)
+	}
+	paths.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleError(w, r, nil, http.StatusNotFound)
+	})
+	mux.Handle("/", paths)
+	return mux, paths
+}
+
+// Checks the API key before the handler is called
+func authorized(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := authorize(w, r, role); ok {
+			handler(w, r)
+		}
+	}
+}
+
+// Returns the value of the Allow header for a path with the given methods
+func allowHeader(methods []string) string {
+	all := map[string]bool{http.MethodOptions: true}
+	for _, method := range methods {
+		all[method] = true
+		// GET routes also answer HEAD
+		if method == http.MethodGet {
+			all[http.MethodHead] = true
+		}
+	}
+	var list []string
+	for method := range all {
+		list = append(list, method)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// Answers the methods a path does not have
+func methodNotAllowed(allow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handleError(w, r, nil, http.StatusMethodNotAllowed)
+	}
+}
+
+// Sends every request to the router, after giving it a request ID.
+// CORS preflight requests are answered here and never reach the router.
+// All requests are counted in the metrics and written to the access log.
+// A handler that panics is answered with a 500 error instead of a closed connection.
+func handleRouter(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	observeRequest(w, r, func(w http.ResponseWriter, r *http.Request) {
+		defer recoverPanic(w, r)
+		if handleCORS(w, r) {
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// Logs the panic of a handler with the stack, and answers 500 with the error body.
+// It has to be called with defer.
+func recoverPanic(w http.ResponseWriter, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler {
+		// The handler wants the connection closed, net/http does it without logging
+		panic(p)
+	}
+	handleError(w, r, fmt.Errorf("handler panicked: %v\n%s", p, debug.Stack()), http.StatusInternalServerError)
+}
+
+type requestIDContext struct{}
+
+// Uses the X-Request-ID header from the client, or makes a new ID,
+// and sends it back in the response so errors can be traced
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 {
+		id = bson.NewObjectId().Hex()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDContext{}, id))
+}
+
+// Returns the ID of the request
+func requestID(r *http.Request) string {
+	return requestIDFrom(r.Context())
+}
+
+// Returns the request ID kept in the context, or "" if there is none
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContext{}).(string)
+	return id
+}
+
+// Returns a context with the given request ID, for work that continues
+// after the request, like jobs and webhook deliveries
+func contextWithRequestID(id string) context.Context {
+	return context.WithValue(context.Background(), requestIDContext{}, id)
+}
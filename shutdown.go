@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The timeouts of the http server. The write timeout has to be long enough
+// for uploads that download a track or import a large archive.
+// They are set by applyConfig.
+var serverReadHeaderTimeout time.Duration
+var serverReadTimeout time.Duration
+var serverWriteTimeout time.Duration
+var serverIdleTimeout time.Duration
+
+// How long the program waits for requests, jobs and webhooks to finish when it is stopped
+var shutdownTimeout time.Duration
+
+// Set when the program has started to shut down, /readyz then answers 503
+var shuttingDown atomic.Bool
+
+// Makes the http server with the timeouts
+func newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+}
+
+// Blocks until the program gets SIGTERM or SIGINT
+func waitForSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logger.Info("Shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
+}
+
+// Stops the program in order, within SHUTDOWN_TIMEOUT:
+// the server stops accepting requests and waits for the ones in progress,
+// then the workers finish the queued jobs, then the queued webhooks are posted
+// and last the database session is closed.
+func shutdown(server *http.Server) error {
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	close(stopJobs)
+	jobsStopped := make(chan struct{})
+	go func() {
+		jobWorkers.Wait()
+		close(jobsStopped)
+	}()
+	select {
+	case <-jobsStopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	close(stopWebhooks)
+	select {
+	case <-webhooksStopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if storeConnected.Load() {
+		storeConnected.Store(false)
+		db.Session.Close()
+	}
+	return nil
+}
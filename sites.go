@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	igc "github.com/marni/goigc"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The radius in metres of imported sites that do not have one
+const siteDefaultRadius = 500.0
+
+// The number of sites in favourite_sites of a pilot
+const favouriteSitesCount = 3
+
+// Returns the first and the last fix of the track, or nil if it has no fixes
+func getTrackEnds(s igc.Track) (*TrackFix, *TrackFix) {
+	if len(s.Points) == 0 {
+		return nil, nil
+	}
+	return fixFromPoint(s.Points[0]), fixFromPoint(s.Points[len(s.Points)-1])
+}
+
+// Makes a TrackFix of a point from the igc file
+func fixFromPoint(p igc.Point) *TrackFix {
+	return &TrackFix{
+		Latitude:  p.Lat.Degrees(),
+		Longitude: p.Lng.Degrees(),
+		Altitude:  int64(fixAltitude(p)),
+	}
+}
+
+// Returns the distance in metres from the site to the fix
+func siteDistance(site Site, fix TrackFix) float64 {
+	a := igc.NewPointFromLatLng(site.Latitude, site.Longitude)
+	b := igc.NewPointFromLatLng(fix.Latitude, fix.Longitude)
+	return a.Distance(b) * 1000
+}
+
+// Returns the id of the nearest site the fix is within the radius of, or "" if there is none
+func nearestSite(sites []Site, fix *TrackFix) string {
+	if fix == nil {
+		return ""
+	}
+	id := ""
+	best := 0.0
+	for _, site := range sites {
+		distance := siteDistance(site, *fix)
+		if distance <= site.Radius && (id == "" || distance < best) {
+			id = site.ID.Hex()
+			best = distance
+		}
+	}
+	return id
+}
+
+// Sets the takeoff and landing site of the track from its first and last fix.
+// There are few sites, so all of them are compared with the fixes.
+func (m *IgcFiles) tagTrackSites(track *Track) {
+	sites, err := m.FindAllSites()
+	if err != nil {
+		m.logger().Warn("Finding the sites of the track failed", "err", err)
+		return
+	}
+	track.TakeoffSite = nearestSite(sites, track.Takeoff)
+	track.LandingSite = nearestSite(sites, track.Landing)
+}
+
+// This function returns all sites sorted by name
+func (m *IgcFiles) FindAllSites() ([]Site, error) {
+	var sites []Site
+	err := db.C(SITES).Find(nil).Sort("name").All(&sites)
+	return sites, err
+}
+
+// This function finds the site with the given id
+func (m *IgcFiles) FindSite(id string) (Site, error) {
+	var site Site
+	err := db.C(SITES).FindId(bson.ObjectIdHex(id)).One(&site)
+	return site, err
+}
+
+// This function inserts a new site into the database
+func (m *IgcFiles) InsertSite(site Site) error {
+	return db.C(SITES).Insert(&site)
+}
+
+// This function inserts the site, or updates the site with the same name.
+// Returns true if the site is new.
+func (m *IgcFiles) UpsertSite(site Site) (bool, error) {
+	info, err := db.C(SITES).Upsert(bson.M{"name_key": site.NameKey}, bson.M{
+		"$set": bson.M{
+			"name":      site.Name,
+			"latitude":  site.Latitude,
+			"longitude": site.Longitude,
+			"radius":    site.Radius,
+			"elevation": site.Elevation,
+		},
+		"$setOnInsert": bson.M{
+			"_id":     bson.NewObjectId(),
+			"created": time.Now().UTC(),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return info.UpsertedId != nil, nil
+}
+
+// This function tags the stored tracks with their takeoff and landing site again.
+// It is run when sites are imported, since a new or moved site can change the sites of old tracks.
+// Tracks stored before the first and last fix were saved have no fixes and are left out,
+// they get them when site suggestions are made, see backfillTrack.
+func (m *IgcFiles) TagSiteTracks() error {
+	sites, err := m.FindAllSites()
+	if err != nil {
+		return err
+	}
+	var tracks []Track
+	err = db.C(COLLECTION).Find(bson.M{"takeoff": bson.M{"$exists": true}}).
+		Select(bson.M{"takeoff": 1, "landing": 1, "takeoff_site": 1, "landing_site": 1}).All(&tracks)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		takeoff := nearestSite(sites, track.Takeoff)
+		landing := nearestSite(sites, track.Landing)
+		if takeoff == track.TakeoffSite && landing == track.LandingSite {
+			continue
+		}
+		set := bson.M{"takeoff_site": takeoff, "landing_site": landing}
+		if err := db.C(COLLECTION).UpdateId(track.ID, bson.M{"$set": set}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A site in the statistics of a pilot
+type PilotSite struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Flights int    `json:"flights"`
+}
+
+// Returns the sites the most of the tracks took off from, the most used first
+func (m *IgcFiles) favouriteSites(tracks []Track) ([]PilotSite, error) {
+	favourites := []PilotSite{}
+	counts := map[string]int{}
+	for _, track := range tracks {
+		if track.TakeoffSite != "" {
+			counts[track.TakeoffSite]++
+		}
+	}
+	if len(counts) == 0 {
+		return favourites, nil
+	}
+	sites, err := m.FindAllSites()
+	if err != nil {
+		return favourites, err
+	}
+	for _, site := range sites {
+		if count := counts[site.ID.Hex()]; count > 0 {
+			favourites = append(favourites, PilotSite{site.ID.Hex(), site.Name, count})
+		}
+	}
+	sort.SliceStable(favourites, func(i, j int) bool {
+		return favourites[i].Flights > favourites[j].Flights
+	})
+	if len(favourites) > favouriteSitesCount {
+		favourites = favourites[:favouriteSitesCount]
+	}
+	return favourites, nil
+}
+
+// A line of a site file that could not be imported
+type siteImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type siteImportReport struct {
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Errors  []siteImportError `json:"errors"`
+}
+
+// The names the columns of a site file can have. SeeYou waypoint files (.cup) use
+// lat, lon and elev, and the names are compared without case.
+var siteColumns = map[string]string{
+	"name":      "name",
+	"title":     "name",
+	"lat":       "latitude",
+	"latitude":  "latitude",
+	"lon":       "longitude",
+	"lng":       "longitude",
+	"longitude": "longitude",
+	"elev":      "elevation",
+	"elevation": "elevation",
+	"radius":    "radius",
+}
+
+// Reads the sites from a CSV or SeeYou waypoint file. The first line names the columns,
+// name, latitude and longitude are required, elevation and radius are optional.
+// Returns the sites and the lines that could not be read.
+func parseSites(data []byte) ([]Site, []siteImportError, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("the file has no header line: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		if column, ok := siteColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			if _, seen := columns[column]; !seen {
+				columns[column] = i
+			}
+		}
+	}
+	for _, column := range []string{"name", "latitude", "longitude"} {
+		if _, ok := columns[column]; !ok {
+			return nil, nil, fmt.Errorf("the file has no %s column", column)
+		}
+	}
+
+	sites := []Site{}
+	errors := []siteImportError{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			errors = append(errors, siteImportError{line, err.Error()})
+			continue
+		}
+		// Waypoint files have the tasks after the waypoints
+		if strings.HasPrefix(record[0], "-----") {
+			break
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		site, err := parseSite(record, columns)
+		if err != nil {
+			errors = append(errors, siteImportError{line, err.Error()})
+			continue
+		}
+		sites = append(sites, site)
+	}
+	return sites, errors, nil
+}
+
+// Makes a site of one line of a site file
+func parseSite(record []string, columns map[string]int) (Site, error) {
+	field := func(column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	site := Site{Name: field("name"), Radius: siteDefaultRadius}
+	site.NameKey = nameKey(site.Name)
+	if site.NameKey == "" {
+		return site, fmt.Errorf("the site has no name")
+	}
+	var err error
+	if site.Latitude, err = parseCoordinate(field("latitude"), "NS", 90); err != nil {
+		return site, err
+	}
+	if site.Longitude, err = parseCoordinate(field("longitude"), "EW", 180); err != nil {
+		return site, err
+	}
+	if value := field("elevation"); value != "" {
+		if site.Elevation, err = parseElevation(value); err != nil {
+			return site, err
+		}
+	}
+	if value := field("radius"); value != "" {
+		site.Radius, err = strconv.ParseFloat(value, 64)
+		if err != nil || site.Radius <= 0 {
+			return site, fmt.Errorf("the radius %q is not a positive number of metres", value)
+		}
+	}
+	return site, nil
+}
+
+// Reads a coordinate in decimal degrees ("61.1234"), or as degrees and minutes
+// the way waypoint files write it ("6107.404N", "01024.200E").
+// hemispheres is the letter of the positive and the negative hemisphere.
+func parseCoordinate(value string, hemispheres string, max float64) (float64, error) {
+	degrees, err := strconv.ParseFloat(value, 64)
+	if err != nil && len(value) > 1 {
+		sign := 0.0
+		switch strings.ToUpper(value[len(value)-1:]) {
+		case hemispheres[0:1]:
+			sign = 1
+		case hemispheres[1:2]:
+			sign = -1
+		}
+		// The minutes are the two digits before the decimal point
+		number := value[:len(value)-1]
+		point := strings.Index(number, ".")
+		if point == -1 {
+			point = len(number)
+		}
+		if sign != 0 && point > 2 {
+			d, errD := strconv.ParseFloat(number[:point-2], 64)
+			m, errM := strconv.ParseFloat(number[point-2:], 64)
+			if errD == nil && errM == nil && m < 60 {
+				degrees, err = sign*(d+m/60), nil
+			}
+		}
+	}
+	if err != nil || degrees < -max || degrees > max {
+		return 0, fmt.Errorf("the coordinate %q is not valid", value)
+	}
+	return degrees, nil
+}
+
+// Reads an elevation in metres, "1234", "1234m" or "4049ft"
+func parseElevation(value string) (float64, error) {
+	factor := 1.0
+	number := strings.ToLower(value)
+	if strings.HasSuffix(number, "ft") {
+		factor = 0.3048
+		number = strings.TrimSuffix(number, "ft")
+	} else {
+		number = strings.TrimSuffix(number, "m")
+	}
+	elevation, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil {
+		return 0, fmt.Errorf("the elevation %q is not valid", value)
+	}
+	return elevation * factor, nil
+}
+
+// Returns all sites
+func handleGetParaglidingAPISites(w http.ResponseWriter, r *http.Request) {
+	sites, err := IGF.For(r).FindAllSites()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if sites == nil {
+		sites = []Site{}
+	}
+	JsonStringResponse(w, http.StatusOK, sites)
+}
+
+// Returns the site with the given ID
+func handleGetParaglidingAPISiteID(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	site, err := IGF.For(r).FindSite(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	JsonStringResponse(w, http.StatusOK, site)
+}
+
+// Returns the IDs of the tracks that took off or landed at the site.
+// ?at=takeoff or ?at=landing only returns one of them.
+func handleGetParaglidingAPISiteIDTracks(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	var query bson.M
+	switch at := r.URL.Query().Get("at"); at {
+	case "":
+		query = bson.M{"$or": []bson.M{{"takeoff_site": tmp}, {"landing_site": tmp}}}
+	case "takeoff":
+		query = bson.M{"takeoff_site": tmp}
+	case "landing":
+		query = bson.M{"landing_site": tmp}
+	default:
+		handleError(w, r, fmt.Errorf("at must be takeoff or landing, not %q", at), http.StatusBadRequest)
+		return
+	}
+
+	store := IGF.For(r)
+	// Answers 404 if the site does not exist
+	if _, err := store.FindSite(tmp); err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	tracks, err := store.FindAll(query)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	ids := []string{}
+	for _, track := range tracks {
+		ids = append(ids, track.ID.Hex())
+	}
+	JsonStringResponse(w, http.StatusOK, ids)
+}
+
+// Imports sites from a CSV or SeeYou waypoint file in the body.
+// Sites with the name of a stored site replace it, and the stored tracks are tagged again.
+func handlePostAdminApiSitesImport(w http.ResponseWriter, r *http.Request) {
+	// Reads one byte more than allowed, to know if the file is too large
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, importMaxBytes+1))
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > importMaxBytes {
+		handleError(w, r, fmt.Errorf("the file is larger than %d bytes", importMaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sites, lineErrors, err := parseSites(data)
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	store := IGF.For(r)
+	report := siteImportReport{Errors: lineErrors}
+	for _, site := range sites {
+		created, err := store.UpsertSite(site)
+		if err != nil {
+			handleError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+	}
+	if len(sites) > 0 {
+		if err := store.TagSiteTracks(); err != nil {
+			handleError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	JsonStringResponse(w, http.StatusOK, report)
+}
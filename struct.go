@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -11,17 +12,68 @@ type IgcFiles struct {
 	Database string
 	Username string
 	Password string
+	// The context of the request using the store, see WithContext in logging.go
+	ctx context.Context
 }
 
 type Track struct {
-	ID          bson.ObjectId `bson:"_id"`
-	Timestamp   int64         `bson:"timestamp" json:"timestamp"`
-	Url         string        `bson:"track_src_url" json:"track_src_url"`
-	HDate       time.Time     `bson:"H_date" json:"H_date"`
-	Pilot       string        `bson:"pilot" json:"pilot"`
-	Glider      string        `bson:"glider" json:"glider"`
-	GliderID    string        `bson:"glider_id" json:"glider_id"`
-	TrackLenght float64       `bson:"track_lenght" json:"track_lenght"`
+	ID          bson.ObjectId   `bson:"_id"`
+	Timestamp   int64           `bson:"timestamp" json:"timestamp"`
+	Url         string          `bson:"track_src_url" json:"track_src_url"`
+	HDate       time.Time       `bson:"H_date" json:"H_date"`
+	Pilot       string          `bson:"pilot" json:"pilot"`
+	Glider      string          `bson:"glider" json:"glider"`
+	GliderID    string          `bson:"glider_id" json:"glider_id"`
+	TrackLenght float64         `bson:"track_lenght" json:"track_lenght"`
+	Owner       string          `bson:"owner" json:"owner"`
+	OwnerKey    string          `bson:"owner_key,omitempty" json:"owner_key,omitempty"`
+	ContentHash string          `bson:"content_hash,omitempty" json:"content_hash,omitempty"`
+	Validation  TrackValidation `bson:"validation" json:"validation"`
+	Notes       string          `bson:"notes,omitempty" json:"notes,omitempty"`
+	Tags        []string        `bson:"tags,omitempty" json:"tags,omitempty"`
+	// The header values from the igc file, saved the first time the track is edited
+	OriginalHeader *TrackHeader `bson:"original_header,omitempty" json:"original_header,omitempty"`
+	EditedAt       *time.Time   `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	EditedBy       string       `bson:"edited_by,omitempty" json:"edited_by,omitempty"`
+	// Set when the track is moved to the trash
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	// Seconds from the first to the last fix
+	Duration int64 `bson:"duration,omitempty" json:"duration,omitempty"`
+	// The pilot the track is linked to by the name in the header, see pilots.go
+	PilotID string `bson:"pilot_id,omitempty" json:"pilot_id,omitempty"`
+	// The glider in the registry the track is linked to by the glider in the header, see gliders.go
+	GliderRef   string            `bson:"glider_ref,omitempty" json:"glider_ref,omitempty"`
+	Performance *TrackPerformance `bson:"performance,omitempty" json:"performance,omitempty"`
+	// The first and the last fix, and the sites they are at, see sites.go
+	Takeoff     *TrackFix `bson:"takeoff,omitempty" json:"takeoff,omitempty"`
+	Landing     *TrackFix `bson:"landing,omitempty" json:"landing,omitempty"`
+	TakeoffSite string    `bson:"takeoff_site,omitempty" json:"takeoff_site,omitempty"`
+	LandingSite string    `bson:"landing_site,omitempty" json:"landing_site,omitempty"`
+	// Where the track was flown, see geo.go
+	Path *TrackPath `bson:"path,omitempty" json:"path,omitempty"`
+}
+
+// A position in a track
+type TrackFix struct {
+	Latitude  float64 `bson:"latitude" json:"latitude"`
+	Longitude float64 `bson:"longitude" json:"longitude"`
+	// Metres above sea level
+	Altitude int64 `bson:"altitude" json:"altitude"`
+}
+
+// The editable values of a track as they were read from the igc file
+type TrackHeader struct {
+	Pilot    string `bson:"pilot" json:"pilot"`
+	Glider   string `bson:"glider" json:"glider"`
+	GliderID string `bson:"glider_id" json:"glider_id"`
+}
+
+// The result of checking the security record (G-record) of an igc file
+type TrackValidation struct {
+	Status       string `bson:"status" json:"status"`
+	GRecord      bool   `bson:"g_record" json:"g_record"`
+	Manufacturer string `bson:"manufacturer" json:"manufacturer"`
+	RecorderID   string `bson:"recorder_id" json:"recorder_id"`
 }
 
 type Webhooks struct {
@@ -30,3 +82,80 @@ type Webhooks struct {
 	MinTriggerValue  int           `bson:"minTriggerValue" json:"minTriggerValue"`
 	LatestKnownTrack int64         `bson:"latestKnownTrack" json:"latestKnownTrack"`
 }
+
+// An API key as stored in the database. Only the sha256 hash of the key is
+// stored, the key itself is shown once when it is created.
+type APIKey struct {
+	ID      bson.ObjectId `bson:"_id" json:"id"`
+	Name    string        `bson:"name" json:"name"`
+	Role    string        `bson:"role" json:"role"`
+	Hash    string        `bson:"key_hash" json:"-"`
+	Created time.Time     `bson:"created" json:"created"`
+	// How many tracks the key can upload each day, 0 uses UPLOAD_DAILY_QUOTA and unlimitedQuota has no limit
+	DailyQuota int        `bson:"daily_quota" json:"daily_quota"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// The raw igc file of a track, stored with the same ID as the track
+type IgcContent struct {
+	ID      bson.ObjectId `bson:"_id"`
+	Content []byte        `bson:"content"`
+}
+
+// An ingestion job, for tracks and archives that are processed in the background
+type Job struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Kind      string        `bson:"kind" json:"kind"`
+	State     string        `bson:"state" json:"state"`
+	Url       string        `bson:"url,omitempty" json:"url,omitempty"`
+	OwnerKey  string        `bson:"owner_key,omitempty" json:"-"`
+	TrackID   string        `bson:"track_id,omitempty" json:"track_id,omitempty"`
+	Duplicate bool          `bson:"duplicate,omitempty" json:"duplicate,omitempty"`
+	Error     string        `bson:"error,omitempty" json:"error,omitempty"`
+	Report    *importReport `bson:"report,omitempty" json:"report,omitempty"`
+	// The ID of the request that created the job
+	RequestID string    `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	Created   time.Time `bson:"created" json:"created"`
+	Updated   time.Time `bson:"updated" json:"updated"`
+}
+
+// A pilot with the names that are used for it in igc files
+type Pilot struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Name        string        `bson:"name" json:"name"`
+	Aliases     []string      `bson:"aliases" json:"aliases"`
+	Nationality string        `bson:"nationality,omitempty" json:"nationality,omitempty"`
+	LicenceID   string        `bson:"licence_id,omitempty" json:"licence_id,omitempty"`
+	// The name and aliases made by nameKey, tracks are linked by them
+	NameKeys []string  `bson:"name_keys" json:"-"`
+	Created  time.Time `bson:"created" json:"created"`
+}
+
+// A glider model in the registry. Tracks are linked to it by the glider in their header.
+type Glider struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	Manufacturer string        `bson:"manufacturer" json:"manufacturer"`
+	Model        string        `bson:"model" json:"model"`
+	Size         string        `bson:"size,omitempty" json:"size,omitempty"`
+	// The EN or LTF certification, see gliderClasses
+	Class string `bson:"class" json:"class"`
+	// Other ways the glider is written in igc headers
+	Aliases []string `bson:"aliases" json:"aliases"`
+	// The full name and aliases made by nameKey, tracks are linked by them
+	NameKeys []string  `bson:"name_keys" json:"-"`
+	Created  time.Time `bson:"created" json:"created"`
+}
+
+// A takeoff or landing site. A track is at the site if its first or last fix is within the radius.
+type Site struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Name      string        `bson:"name" json:"name"`
+	Latitude  float64       `bson:"latitude" json:"latitude"`
+	Longitude float64       `bson:"longitude" json:"longitude"`
+	// Metres
+	Radius    float64 `bson:"radius" json:"radius"`
+	Elevation float64 `bson:"elevation" json:"elevation"`
+	// The name made by nameKey, a site with the same name is updated when sites are imported
+	NameKey string    `bson:"name_key" json:"-"`
+	Created time.Time `bson:"created" json:"created"`
+}
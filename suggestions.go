@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Takeoffs closer than this many metres to another takeoff are in the same cluster
+	siteClusterDistance = 300.0
+	// A cluster needs this many tracks to be suggested as a site
+	siteSuggestionMinTracks = 3
+)
+
+// A place many tracks took off from that is not a known site
+type SiteSuggestion struct {
+	// Made from the tracks in the cluster, so it changes when a track is added to it
+	ID        string  `json:"id"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// The metres from the centre to the takeoff furthest away, at least siteDefaultRadius
+	Radius float64 `json:"radius"`
+	Tracks int     `json:"count"`
+	// The lowest and highest takeoff altitude in metres
+	MinAltitude int64 `json:"min_altitude"`
+	MaxAltitude int64 `json:"max_altitude"`
+}
+
+// Clusters the takeoffs of the tracks that did not take off from a known site,
+// and returns the clusters with enough tracks, the most used first.
+// Tracks stored before the first fix was saved get it from their igc file.
+func (m *IgcFiles) SiteSuggestions() ([]SiteSuggestion, error) {
+	var tracks []Track
+	err := db.C(COLLECTION).Find(live(bson.M{"takeoff_site": bson.M{"$in": []interface{}{nil, ""}}})).
+		Select(bson.M{"takeoff": 1}).All(&tracks)
+	if err != nil {
+		return nil, err
+	}
+	takeoffs := []Track{}
+	for _, track := range tracks {
+		if track.Takeoff == nil {
+			m.backfillTrack(&track)
+		}
+		if track.Takeoff != nil && track.TakeoffSite == "" {
+			takeoffs = append(takeoffs, track)
+		}
+	}
+
+	suggestions := []SiteSuggestion{}
+	for _, cluster := range clusterTakeoffs(takeoffs) {
+		if len(cluster) >= siteSuggestionMinTracks {
+			suggestions = append(suggestions, makeSiteSuggestion(cluster))
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Tracks > suggestions[j].Tracks
+	})
+	return suggestions, nil
+}
+
+// Puts the tracks with takeoffs closer than siteClusterDistance to each other in the same cluster.
+// Every takeoff is compared with every other, which is fine for the number of unknown takeoffs we have.
+func clusterTakeoffs(tracks []Track) [][]Track {
+	// The index of the first track of the cluster each track is in
+	parent := make([]int, len(tracks))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range tracks {
+		site := Site{Latitude: tracks[i].Takeoff.Latitude, Longitude: tracks[i].Takeoff.Longitude}
+		for j := i + 1; j < len(tracks); j++ {
+			if siteDistance(site, *tracks[j].Takeoff) <= siteClusterDistance {
+				a, b := root(i), root(j)
+				if a > b {
+					a, b = b, a
+				}
+				parent[b] = a
+			}
+		}
+	}
+
+	clusters := [][]Track{}
+	index := map[int]int{}
+	for i, track := range tracks {
+		r := root(i)
+		if _, ok := index[r]; !ok {
+			index[r] = len(clusters)
+			clusters = append(clusters, []Track{})
+		}
+		clusters[index[r]] = append(clusters[index[r]], track)
+	}
+	return clusters
+}
+
+// Makes the suggestion of a cluster of takeoffs
+func makeSiteSuggestion(cluster []Track) SiteSuggestion {
+	suggestion := SiteSuggestion{
+		Tracks:      len(cluster),
+		MinAltitude: cluster[0].Takeoff.Altitude,
+		MaxAltitude: cluster[0].Takeoff.Altitude,
+		Radius:      siteDefaultRadius,
+	}
+	ids := []string{}
+	for _, track := range cluster {
+		suggestion.Latitude += track.Takeoff.Latitude / float64(len(cluster))
+		suggestion.Longitude += track.Takeoff.Longitude / float64(len(cluster))
+		if track.Takeoff.Altitude < suggestion.MinAltitude {
+			suggestion.MinAltitude = track.Takeoff.Altitude
+		}
+		if track.Takeoff.Altitude > suggestion.MaxAltitude {
+			suggestion.MaxAltitude = track.Takeoff.Altitude
+		}
+		ids = append(ids, track.ID.Hex())
+	}
+	centre := Site{Latitude: suggestion.Latitude, Longitude: suggestion.Longitude}
+	for _, track := range cluster {
+		suggestion.Radius = math.Max(suggestion.Radius, math.Ceil(siteDistance(centre, *track.Takeoff)))
+	}
+	// The same tracks always give the same id
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+	suggestion.ID = hex.EncodeToString(sum[:])[:16]
+	return suggestion
+}
+
+// Returns the suggested sites
+func handleGetAdminApiSiteSuggestions(w http.ResponseWriter, r *http.Request) {
+	suggestions, err := IGF.For(r).SiteSuggestions()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	JsonStringResponse(w, http.StatusOK, suggestions)
+}
+
+// Adds the suggested site with the given ID to the sites, with the name in the body.
+// The radius and elevation of the suggestion can be changed in the body too.
+func handlePostAdminApiSiteSuggestionAccept(w http.ResponseWriter, r *http.Request) {
+	type getParams struct {
+		Name      string   `json:"name"`
+		Radius    *float64 `json:"radius"`
+		Elevation *float64 `json:"elevation"`
+	}
+	var params getParams
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if nameKey(params.Name) == "" {
+		handleError(w, r, fmt.Errorf("name is required"), http.StatusBadRequest)
+		return
+	}
+	if params.Radius != nil && *params.Radius <= 0 {
+		handleError(w, r, fmt.Errorf("radius must be a positive number of metres"), http.StatusBadRequest)
+		return
+	}
+
+	store := IGF.For(r)
+	suggestions, err := store.SiteSuggestions()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	var suggestion *SiteSuggestion
+	for i := range suggestions {
+		if suggestions[i].ID == r.PathValue("id") {
+			suggestion = &suggestions[i]
+		}
+	}
+	// The id changes when a track is added to the cluster, so the suggestions have to be fetched again
+	if suggestion == nil {
+		handleError(w, r, &apiError{http.StatusNotFound, "suggestion_not_found", "no suggestion has this id, the suggestions may have changed", nil}, http.StatusNotFound)
+		return
+	}
+
+	// The lowest takeoff is the closest to the ground
+	site := Site{
+		ID:        bson.NewObjectId(),
+		Name:      strings.TrimSpace(params.Name),
+		NameKey:   nameKey(params.Name),
+		Latitude:  suggestion.Latitude,
+		Longitude: suggestion.Longitude,
+		Radius:    suggestion.Radius,
+		Elevation: float64(suggestion.MinAltitude),
+		Created:   time.Now().UTC(),
+	}
+	if params.Radius != nil {
+		site.Radius = *params.Radius
+	}
+	if params.Elevation != nil {
+		site.Elevation = *params.Elevation
+	}
+	if err := store.InsertSite(site); err != nil {
+		if mgo.IsDup(err) {
+			handleError(w, r, &apiError{http.StatusConflict, "site_name_taken", "another site already has this name", nil}, http.StatusConflict)
+			return
+		}
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := store.TagSiteTracks(); err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/paragliding/api/sites/"+site.ID.Hex())
+	JsonStringResponse(w, http.StatusCreated, site)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// How long deleted tracks are kept in the trash before they are removed for good
+var trashRetention time.Duration
+
+// Returns all tracks in the trash, the most recently deleted first
+func (m *IgcFiles) FindTrash() ([]Track, error) {
+	defer m.observe("find_trash")()
+	var tracks []Track
+	err := db.C(COLLECTION).Find(bson.M{"deleted_at": bson.M{"$exists": true}}).Sort("-deleted_at").All(&tracks)
+	return tracks, err
+}
+
+// Takes the track with the given id out of the trash and returns it
+func (m *IgcFiles) RestoreOne(id string) (Track, error) {
+	defer m.observe("restore_one")()
+	var track Track
+	change := mgo.Change{
+		Update:    bson.M{"$unset": bson.M{"deleted_at": ""}},
+		ReturnNew: true,
+	}
+	_, err := db.C(COLLECTION).Find(bson.M{
+		"_id":        bson.ObjectIdHex(id),
+		"deleted_at": bson.M{"$exists": true},
+	}).Apply(change, &track)
+	return track, err
+}
+
+// Removes the tracks, and their igc files, that were moved to the trash before the given time
+func (m *IgcFiles) PurgeTrash(before time.Time) (*mgo.ChangeInfo, error) {
+	defer m.observe("purge_trash")()
+	var ids []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	query := bson.M{"deleted_at": bson.M{"$lt": before}}
+	if err := db.C(COLLECTION).Find(query).Select(bson.M{"_id": 1}).All(&ids); err != nil {
+		return nil, err
+	}
+	changeInfo, err := db.C(COLLECTION).RemoveAll(query)
+	if err != nil {
+		return changeInfo, err
+	}
+	for _, id := range ids {
+		if err := db.C(IGCFILES).RemoveId(id.ID); err != nil && err != mgo.ErrNotFound {
+			return changeInfo, err
+		}
+	}
+	return changeInfo, nil
+}
+
+// Purges the trash once every hour, for as long as the program runs
+func purgeTrashLoop() {
+	if trashRetention <= 0 {
+		logger.Warn("TRASH_RETENTION is not a positive duration, the trash is never purged")
+		return
+	}
+	for {
+		changeInfo, err := IGF.PurgeTrash(time.Now().Add(-trashRetention))
+		if err != nil {
+			logger.Error("Purging the trash failed", "err", err)
+		} else if changeInfo.Removed > 0 {
+			logger.Info("Purged tracks from the trash", "count", changeInfo.Removed)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// Returns all tracks in the trash
+func handleGetAdminApiTrash(w http.ResponseWriter, r *http.Request) {
+	tracks, err := IGF.For(r).FindTrash()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if tracks == nil {
+		tracks = []Track{}
+	}
+	JsonStringResponse(w, http.StatusOK, tracks)
+}
+
+// Restores the track with the ID given in /admin/api/trash/<id>/restore
+func handlePostAdminApiTrashRestore(w http.ResponseWriter, r *http.Request) {
+	tmp := r.PathValue("id")
+	if !bson.IsObjectIdHex(tmp) {
+		handleError(w, r, errInvalidID, http.StatusBadRequest)
+		return
+	}
+	track, err := IGF.For(r).RestoreOne(tmp)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	JsonStringResponse(w, http.StatusOK, track)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+
+	igc "github.com/marni/goigc"
+)
+
+// The validation status stored on every track.
+// The G-record is not verified, so a signed file can not be told apart from an edited one.
+const (
+	// The file has no G-record
+	validationUnsigned = "unsigned"
+	// The file has a G-record, but it is not verified
+	validationUnsupported = "unsupported"
+)
+
+var validationStatuses = map[string]bool{
+	validationUnsigned:    true,
+	validationUnsupported: true,
+}
+
+// Finds out if the igc file is signed with a G-record, and by which flight recorder.
+// Checking the G-record needs the algorithm of the manufacturer of the recorder,
+// and none of them are implemented, so signed files are stored as unsupported.
+func validateTrack(track igc.Track) TrackValidation {
+	validation := TrackValidation{
+		GRecord:      track.Signature != "",
+		Manufacturer: strings.ToUpper(track.Manufacturer),
+		RecorderID:   track.UniqueID,
+	}
+	if !validation.GRecord {
+		validation.Status = validationUnsigned
+		return validation
+	}
+	validation.Status = validationUnsupported
+	return validation
+}